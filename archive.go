@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// packディレクトリ以下に作るディレクトリのモード
+// 展開先だけでなくstart/optやロック用のディレクトリも、umaskに依らずこのモードに揃える
+const extractDirMode fs.FileMode = 0755
+
+// 展開するファイルのモードを決める
+// アーカイブ内のmodeからは実行ビットだけを引き継ぎ、0755か0644にする
+// 0777や0666のように他のユーザーが書き込めるmodeはそのまま使わない
+// UNIXで作られたアーカイブのmodeをWindowsにそのまま適用すると
+// 読み取り専用になることがあるので、Windowsでは0644固定にする
+func extractFileMode(mode fs.FileMode) fs.FileMode {
+	if runtime.GOOS != "windows" && mode.Perm()&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// falseの場合、アーカイブ内のシンボリックリンクは作成せずに無視する
+var allowSymlinks = true
+
+// zip/tarの展開エントリを抽象化したもの
+type archiveEntry struct {
+	name string
+	mode fs.FileMode
+	open func() (io.ReadCloser, error)
+	// シンボリックリンクの場合のリンク先
+	linkname string
+}
+
+// トップレベルディレクトリ剥がしのロジックをzip/tarで共通化するためのインターフェース
+type archive interface {
+	// 全エントリの名前を返す
+	names() ([]string, error)
+	// 通常ファイル、ディレクトリ、シンボリックリンクのエントリを順に処理する
+	walk(fn func(entry archiveEntry) error) error
+}
+
+type zipArchive struct {
+	r *zip.ReadCloser
+}
+
+func (a zipArchive) names() ([]string, error) {
+	names := make([]string, len(a.r.File))
+	for i, f := range a.r.File {
+		names[i] = f.Name
+	}
+	return names, nil
+}
+
+func (a zipArchive) walk(fn func(entry archiveEntry) error) error {
+	for _, f := range a.r.File {
+		entry := archiveEntry{
+			name: f.Name,
+			mode: f.Mode(),
+			open: f.Open,
+		}
+		// zipのシンボリックリンクはリンク先パスが中身として格納されている
+		if f.Mode()&os.ModeSymlink != 0 {
+			linkname, err := readZipLink(f)
+			if err != nil {
+				return fmt.Errorf("%s の展開に失敗しました（リンク先の読み込み）: %w", f.Name, err)
+			}
+			entry.linkname = linkname
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tar.gzは先頭から順にしか読めないので、namesとwalkでそれぞれファイルを開き直す
+type tarGzArchive struct {
+	path string
+}
+
+func (a tarGzArchive) names() ([]string, error) {
+	var names []string
+	err := a.each(func(hdr *tar.Header, _ io.Reader) error {
+		names = append(names, hdr.Name)
+		return nil
+	})
+	return names, err
+}
+
+func (a tarGzArchive) walk(fn func(entry archiveEntry) error) error {
+	return a.each(func(hdr *tar.Header, r io.Reader) error {
+		return fn(archiveEntry{
+			name:     hdr.Name,
+			mode:     hdr.FileInfo().Mode(),
+			open:     func() (io.ReadCloser, error) { return io.NopCloser(r), nil },
+			linkname: hdr.Linkname,
+		})
+	})
+}
+
+// pax_global_headerなど、通常ファイル、ディレクトリ、シンボリックリンク以外のエントリは無視する
+func (a tarGzArchive) each(fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("gzip の読み込みに失敗しました: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar のエントリの読み込みに失敗しました: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func readZipLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// シンボリックリンクを作成する
+// リンク先が展開先の外を指す場合はZip Slipと同様に拒否する
+func extractSymlink(dest, fpath, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("不正なシンボリックリンク: %s -> %s", fpath, linkname)
+	}
+	// 展開済みのシンボリックリンクを経由する場合もあるので、親ディレクトリの実際の場所から判定する
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	parent, err := realPath(filepath.Dir(fpath))
+	if err != nil {
+		return err
+	}
+	if !isWithin(realDest, filepath.Join(parent, linkname)) {
+		return fmt.Errorf("不正なシンボリックリンク: %s -> %s", fpath, linkname)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fpath), extractDirMode); err != nil {
+		return err
+	}
+	// 同名のエントリが既にある場合は置き換える
+	os.Remove(fpath)
+	return os.Symlink(linkname, fpath)
+}
+
+// pathがdirそのものか、dirの中にあるかどうか
+func isWithin(dir, path string) bool {
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// 途中のシンボリックリンクを解決したpathの実際の場所を返す
+// まだ存在しない部分は、存在する親ディレクトリを解決したものにそのまま連結する
+func realPath(path string) (string, error) {
+	rest := ""
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// 展開済みのシンボリックリンクを辿るとdestの外に出てしまうパスを拒否する
+// 文字列としてのパスの検証だけでは、リンクを連鎖させたアーカイブを防げない
+func checkRealPath(dest, fpath string) error {
+	// トップレベルディレクトリのエントリは展開先そのものになる
+	if filepath.Clean(fpath) == filepath.Clean(dest) {
+		return nil
+	}
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	parent, err := realPath(filepath.Dir(fpath))
+	if err != nil {
+		return err
+	}
+	if !isWithin(realDest, parent) {
+		return fmt.Errorf("不正なファイルパス（シンボリックリンクで展開先の外を指しています）: %s", fpath)
+	}
+	return nil
+}
+
+func untarWithoutTopLevel(ctx context.Context, src, dest string) (extractStats, error) {
+	return extractWithoutTopLevel(ctx, tarGzArchive{path: src}, dest)
+}
+
+// URLの拡張子からダウンロードしたファイルの拡張子を決める
+func archiveExt(u string) string {
+	u = strings.ToLower(u)
+	switch {
+	case strings.HasSuffix(u, ".tar.gz"):
+		return ".tar.gz"
+	case strings.HasSuffix(u, ".tgz"):
+		return ".tgz"
+	default:
+		return ".zip"
+	}
+}
+
+// ファイル先頭のマジックナンバー、判定できなければURLの拡張子で形式を判定して展開する
+func extractArchive(ctx context.Context, u, src, dest string) (extractStats, error) {
+	if isTarArchive(u, src) {
+		return untarWithoutTopLevel(ctx, src, dest)
+	}
+	return unzipWithoutTopLevel(ctx, src, dest)
+}
+
+// tar.gzとして展開するかどうか
+// mirror_urlからurlと異なる形式のアーカイブを取得することもあるので、拡張子より中身を優先する
+func isTarArchive(u, path string) bool {
+	return isGzipFile(path) || (archiveExt(u) != ".zip" && !isZipFile(path))
+}
+
+func isGzipFile(path string) bool {
+	return hasMagic(path, []byte{0x1f, 0x8b})
+}
+
+func isZipFile(path string) bool {
+	return hasMagic(path, []byte("PK\x03\x04")) || hasMagic(path, []byte("PK\x05\x06"))
+}
+
+func hasMagic(path string, magic []byte) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return bytes.Equal(head, magic)
+}
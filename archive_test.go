@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type zipTestEntry struct {
+	name string
+	body string
+	// trueの場合、bodyをリンク先とするシンボリックリンクにする
+	symlink bool
+}
+
+// entriesを順に格納したzipをdirに作り、そのパスを返す
+func writeTestZip(t *testing.T, dir string, entries []zipTestEntry) string {
+	t.Helper()
+	path := filepath.Join(dir, "test.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.symlink {
+			hdr.SetMode(os.ModeSymlink | 0777)
+		} else {
+			hdr.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractRejectsChainedSymlinkEscape(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("シンボリックリンクの作成に権限が必要なため")
+	}
+
+	dir := t.TempDir()
+	src := writeTestZip(t, dir, []zipTestEntry{
+		{name: "top/x", body: ".", symlink: true},
+		{name: "top/x/y", body: "..", symlink: true},
+		{name: "top/y/evil.txt", body: "evil"},
+	})
+	dest := filepath.Join(dir, "plugin")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unzipWithoutTopLevel(context.Background(), src, dest); err == nil {
+		t.Fatal("展開先の外を指すシンボリックリンクの連鎖が拒否されませんでした")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "evil.txt")); err == nil {
+		t.Fatal("展開先の外にファイルが作成されました")
+	}
+}
+
+func TestExtractAllowsSymlinkInsideDest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("シンボリックリンクの作成に権限が必要なため")
+	}
+
+	dir := t.TempDir()
+	src := writeTestZip(t, dir, []zipTestEntry{
+		{name: "top/", body: ""},
+		{name: "top/lua/foo.lua", body: "return {}"},
+		{name: "top/plugin", body: "lua", symlink: true},
+		{name: "top/plugin/bar.lua", body: "return {}"},
+	})
+	dest := filepath.Join(dir, "plugin")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unzipWithoutTopLevel(context.Background(), src, dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "lua", "bar.lua")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractRejectsPathTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []zipTestEntry
+	}{
+		{"ルート直下", []zipTestEntry{
+			{name: "README", body: "readme"},
+			{name: "../evil.txt", body: "evil"},
+		}},
+		{"トップレベルディレクトリの下", []zipTestEntry{
+			{name: "top/README", body: "readme"},
+			{name: "top/../../evil.txt", body: "evil"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := writeTestZip(t, dir, tt.entries)
+			dest := filepath.Join(dir, "pack", "plugin")
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := unzipWithoutTopLevel(context.Background(), src, dest)
+			if err == nil || !strings.Contains(err.Error(), "不正なファイルパス") {
+				t.Fatalf("err = %v, want 不正なファイルパス", err)
+			}
+			for _, path := range []string{filepath.Join(dir, "evil.txt"), filepath.Join(dir, "pack", "evil.txt")} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Errorf("展開先の外にファイルが作成されました: %s", path)
+				}
+			}
+		})
+	}
+}
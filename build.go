@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// plugins.ymlのbuildコマンドをプラグインのディレクトリで実行する
+// コマンドはシェル経由（UNIXはsh -c、Windowsはcmd /C）で実行する
+func runBuild(ctx context.Context, dir string, p Plugin) error {
+	if p.Build == "" {
+		return nil
+	}
+
+	name := p.name()
+	logger.Infof("build %s: %s", name, p.Build)
+	if err := runHook(ctx, dir, name, p.Build); err != nil {
+		return fmt.Errorf("%s: buildに失敗しました: %w", p.Repo, err)
+	}
+	return nil
+}
+
+// インストール時に記録したpreremoveコマンドを実行してからディレクトリを削除する
+// plugins.ymlから消されたプラグインでも実行できるよう、コマンドは.ttvpack.jsonから読む
+// ignoreErrorsがfalseの場合、preremoveが失敗したら削除しない
+func removePlugin(ctx context.Context, dir string, ignoreErrors bool) error {
+	if meta, ok := readPluginMeta(dir); ok && meta.Preremove != "" {
+		name := filepath.Base(dir)
+		logger.Infof("preremove %s: %s", name, meta.Preremove)
+		if err := runHook(ctx, dir, name, meta.Preremove); err != nil {
+			err = fmt.Errorf("preremoveに失敗しました: %w", err)
+			if !ignoreErrors {
+				return err
+			}
+			logger.Errorf("%s: %v", name, err)
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// postinstall_nvimのコマンドをheadlessのnvimで実行する
+// optのプラグインは自動では読み込まれないので、先にpackaddしておく
+func runPostinstallNvim(ctx context.Context, kind string, p Plugin) error {
+	if p.PostinstallNvim == "" {
+		return nil
+	}
+	nvim, err := nvimPath()
+	if err != nil {
+		return err
+	}
+
+	name := p.name()
+	logger.Infof("postinstall %s: %s", name, p.PostinstallNvim)
+	args := []string{"--headless"}
+	if kind == "opt" {
+		args = append(args, "-c", "packadd "+makeDirName(p))
+	}
+	args = append(args, "-c", p.PostinstallNvim, "-c", "qa")
+	if err := runCommand(ctx, exec.CommandContext(ctx, nvim, args...), name); err != nil {
+		return fmt.Errorf("%s: postinstall_nvimに失敗しました: %w", p.Repo, err)
+	}
+	return nil
+}
+
+// コマンドをdirで実行し、出力を1行ずつログに出す
+func runHook(ctx context.Context, dir, name, command string) error {
+	cmd := shellCommand(ctx, command)
+	cmd.Dir = dir
+	return runCommand(ctx, cmd, name)
+}
+
+func runCommand(ctx context.Context, cmd *exec.Cmd, name string) error {
+	output, err := cmd.CombinedOutput()
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		ctxLogger(ctx).Infof("  [%s] %s", name, scanner.Text())
+	}
+	return err
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
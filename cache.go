@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// ダウンロードキャッシュを使うかどうか
+var useDownloadCache = true
+
+// キャッシュサイズの上限（超えたら古いものから削除する）
+var maxCacheSize int64 = 1 << 30
+
+// $XDG_CACHE_HOME/ttvpack を返す
+func cacheDir() (string, error) {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		var err error
+		dir, err = os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "ttvpack"), nil
+}
+
+// プラグインのキャッシュファイルのパスを返す
+// 内容が変わらないcommit/tag固定のプラグインのみキャッシュ対象とする
+// 同じrepoとtagでもurlを変えた場合（zipからtar.gzやミラーへの変更など）は別のアーカイブなので、urlのハッシュも名前に含める
+// ローカルのアーカイブはキャッシュしない
+func pluginCachePath(p Plugin, u string) (string, bool) {
+	ref := cmp.Or(p.Commit, p.Tag)
+	if !useDownloadCache || ref == "" {
+		return "", false
+	}
+	if _, ok := localPath(u); ok {
+		return "", false
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return "", false
+	}
+	name := p.Repo + "@" + ref
+	if p.Host != "" {
+		name = p.Host + "-" + name
+	}
+	sum := sha256.Sum256([]byte(u))
+	return filepath.Join(dir, sanitizeDirName(name)+"-"+hex.EncodeToString(sum[:8])+archiveExt(u)), true
+}
+
+// ダウンロード途中のファイルのパスを返す
+// 次回のsyncでも続きから取得できるよう、キャッシュディレクトリにurlごとの名前で置く
+// キャッシュを使わない場合は、同じ実行中のリトライでのみ再開できるようdestの隣に置く
+func partialPath(u, dest string) string {
+	dir, err := cacheDir()
+	if !useDownloadCache || err != nil {
+		return dest + ".part"
+	}
+	sum := sha256.Sum256([]byte(u))
+	return filepath.Join(dir, "partial", hex.EncodeToString(sum[:16])+archiveExt(u)+".part")
+}
+
+// キャッシュディレクトリの.partは複数のpackディレクトリのsyncで共有されるので、使う間は排他ロックをかける
+// 別のプロセスが同じurlを取得中であれば、destの隣の.partを使う
+// 使う.partのパスと、ロックを解放する関数を返す
+func lockPartial(u, dest string) (string, func()) {
+	partPath := partialPath(u, dest)
+	own := dest + ".part"
+	if partPath == own {
+		return own, func() {}
+	}
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		return own, func() {}
+	}
+	// .partは取得完了時に消すので、ロックは別のファイルにかける
+	f, err := os.OpenFile(partPath+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return own, func() {}
+	}
+	if locked, err := tryLockFile(f); err != nil || !locked {
+		f.Close()
+		return own, func() {}
+	}
+	return partPath, func() {
+		unlockFile(f)
+		f.Close()
+	}
+}
+
+// キャッシュにあればそれを使い、無ければダウンロードする
+// キャッシュから取得したかどうかも返す
+func fetchZip(ctx context.Context, name string, p Plugin, u, dest string) (string, bool, error) {
+	if cachePath, ok := pluginCachePath(p, u); ok {
+		if sum, err := copyFileWithHash(cachePath, dest); err == nil {
+			ctxLogger(ctx).Debugf("cache hit %s", name)
+			return sum, true, nil
+		}
+	}
+
+	urls := []string{u}
+	if p.MirrorUrl != "" {
+		urls = append(urls, p.MirrorUrl)
+	}
+	sum, err := downloadWithFallback(ctx, name, p, urls, dest)
+	return sum, false, err
+}
+
+// ダウンロードしたzipをキャッシュに保存する
+// キャッシュへの保存に失敗してもインストール自体は続行する
+func storeCache(p Plugin, u, zipPath string) {
+	cachePath, ok := pluginCachePath(p, u)
+	if !ok {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return
+	}
+	if _, err := copyFileWithHash(zipPath, cachePath); err != nil {
+		os.Remove(cachePath)
+		return
+	}
+	pruneCache(filepath.Dir(cachePath), maxCacheSize)
+}
+
+// キャッシュの合計サイズがlimitを超えていれば古いものから削除する
+func pruneCache(dir string, limit int64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cacheFile
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, cacheFile{filepath.Join(dir, entry.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	slices.SortFunc(files, func(a, b cacheFile) int {
+		return cmp.Compare(a.modTime.UnixNano(), b.modTime.UnixNano())
+	})
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+		}
+	}
+}
+
+func copyFileWithHash(src, dest string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// cacheコマンド
+func cache(args []string) error {
+	if len(args) < 1 || args[0] != "clean" {
+		return errors.New("使い方: ttvpack cache clean")
+	}
+
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		logger.Infof("cache is empty")
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	logger.Infof("removed: %s", dir)
+	return nil
+}
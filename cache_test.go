@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPluginCachePathIncludesUrl(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	p := Plugin{Repo: "u/foo", Tag: "v1"}
+
+	zipPath, ok := pluginCachePath(p, "https://example.com/foo.zip")
+	if !ok {
+		t.Fatal("tag固定のプラグインはキャッシュ対象")
+	}
+	tarPath, _ := pluginCachePath(p, "https://example.com/foo.tar.gz")
+	if zipPath == tarPath {
+		t.Errorf("urlが違うのに同じキャッシュを使います: %s", zipPath)
+	}
+	for _, u := range []string{"./archives/foo.zip", "/tmp/foo.zip", "file:///tmp/foo.zip"} {
+		if path, ok := pluginCachePath(p, u); ok {
+			t.Errorf("ローカルのアーカイブをキャッシュしようとしました: %s -> %s", u, path)
+		}
+	}
+}
+
+func TestFetchZipCacheMissWhenUrlChanged(t *testing.T) {
+	dir := setupDownloadTest(t)
+	src := writeTestZip(t, t.TempDir(), []zipTestEntry{{name: "top/README", body: "readme"}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, src)
+	}))
+	defer srv.Close()
+
+	p := Plugin{Repo: "u/foo", Tag: "v1"}
+	oldUrl := srv.URL + "/foo.tar.gz"
+	newUrl := srv.URL + "/foo.zip"
+	// 以前のurlで取得したアーカイブがキャッシュに残っている
+	old := filepath.Join(dir, "old.tar.gz")
+	if err := os.WriteFile(old, []byte("old archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storeCache(p, oldUrl, old)
+
+	dest := filepath.Join(dir, "foo.zip")
+	_, fromCache, err := fetchZip(context.Background(), "foo-v1", p, newUrl, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromCache {
+		t.Error("urlを変えたのに以前のアーカイブをキャッシュから使いました")
+	}
+
+	// 同じurlならキャッシュを使う
+	_, fromCache, err = fetchZip(context.Background(), "foo-v1", p, oldUrl, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromCache {
+		t.Error("同じurlのキャッシュが使われませんでした")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkの探索でrtpの候補を探す深さ
+const checkSearchDepth = 3
+
+// checkに指定されたファイルが展開後のプラグインにあるかを確認し、無ければ警告する
+// アーカイブの構成が想定と違う場合に気付けるようにするためのもので、インストール自体は失敗にしない
+func verifyCheckFile(ctx context.Context, rootDir string, p Plugin) {
+	if p.Check == "" {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(p.Check))); err == nil {
+		ctxLogger(ctx).Debugf("check ok %s: %s", p.name(), p.Check)
+		return
+	}
+
+	if dir, ok := findCheckDir(rootDir, p.Check); ok {
+		ctxLogger(ctx).Warnf("%s: %sが見つかりません（rtp: %sを指定すると解決する可能性があります）", p.Repo, p.Check, dir)
+		return
+	}
+	ctxLogger(ctx).Warnf("%s: %sが見つかりません（アーカイブの構成を確認してください）", p.Repo, p.Check)
+}
+
+// rootDir以下で、checkのファイルを含むサブディレクトリを探す
+// 見つかった場合はrootDirからの相対パスをスラッシュ区切りで返す
+func findCheckDir(rootDir, check string) (string, bool) {
+	var found string
+	errFound := errors.New("found")
+	filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == rootDir {
+			return nil
+		}
+		rel, err := filepath.Rel(rootDir, path)
+		if err != nil {
+			return nil
+		}
+		if strings.Count(rel, string(filepath.Separator)) >= checkSearchDepth {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, filepath.FromSlash(check))); err == nil {
+			found = filepath.ToSlash(rel)
+			return errFound
+		}
+		return nil
+	})
+	return found, found != ""
+}
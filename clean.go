@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// start/optのpackディレクトリからplugins.ymlに存在しないディレクトリを削除する
+// ダウンロードは一切行わない
+func clean(ctx context.Context, pluginsFilePath, packPath string, args []string) error {
+	flags := flag.NewFlagSet("clean", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "確認せずに削除する")
+	ignorePreremoveErrors := flags.Bool("ignore-preremove-errors", false, "preremoveに失敗してもプラグインを削除する")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+
+	var unused []string
+	for _, group := range pluginGroups(packPath, plugins) {
+		paths, err := findUnusedPlugins(group)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		unused = append(unused, paths...)
+	}
+
+	if len(unused) == 0 {
+		logger.Infof("nothing to clean")
+		return nil
+	}
+
+	logger.Infof("remove targets:")
+	for _, entry := range unused {
+		rel, err := filepath.Rel(packPath, entry)
+		if err != nil {
+			rel = entry
+		}
+		logger.Infof("  %s", rel)
+	}
+	if !*yes && !confirm("削除しますか？") {
+		logger.Infof("canceled")
+		return nil
+	}
+
+	for _, entry := range unused {
+		if err := removePlugin(ctx, entry, *ignorePreremoveErrors); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(entry), err)
+		}
+		logger.Infof("removed: %s", filepath.Base(entry))
+	}
+	return nil
+}
+
+// 標準入力でy/Nの確認を取る
+// sync --jsonの標準出力にJSON以外を混ぜないよう、プロンプトは標準エラー出力に出す
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
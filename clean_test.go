@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// sync --jsonの標準出力を壊さないよう、確認のプロンプトは標準出力に出さない
+func TestConfirmDoesNotWriteStdout(t *testing.T) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin, oldStdout, oldStderr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = stdinR, stdoutW, stderrW
+	defer func() { os.Stdin, os.Stdout, os.Stderr = oldStdin, oldStdout, oldStderr }()
+
+	stdinW.WriteString("y\n")
+	stdinW.Close()
+	got := confirm("削除しますか？")
+	stdoutW.Close()
+	stderrW.Close()
+
+	if !got {
+		t.Error("yの入力で承認されませんでした")
+	}
+	if out, _ := io.ReadAll(stdoutR); len(out) > 0 {
+		t.Errorf("標準出力にプロンプトが出力されました: %q", out)
+	}
+	if out, _ := io.ReadAll(stderrR); len(out) == 0 {
+		t.Error("標準エラー出力にプロンプトが出力されませんでした")
+	}
+}
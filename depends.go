@@ -0,0 +1,147 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+// plugins.ymlをincludeも含めて読み込み、環境変数の展開とdependsで指定された依存プラグインの解決を行う
+// plugins.ymlに書き戻す場合は展開前の値が必要なのでreadPluginsを使うこと
+func loadPlugins(path string) (*Plugins, error) {
+	plugins, err := readPluginsWithIncludes(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := expandPluginsEnv(plugins); err != nil {
+		return nil, fmt.Errorf("%s:\n%w", path, err)
+	}
+	resolveLocalUrls(plugins)
+	resolvePatchPaths(plugins)
+	plugins, err = resolveDependencies(plugins)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNameConflicts(plugins); err != nil {
+		return nil, fmt.Errorf("%s:\n%w", path, err)
+	}
+	return plugins, nil
+}
+
+// 依存先が未定義ならstartに追加し、依存先が先に来るよう並べ替える
+// 循環依存はエラーにする
+func resolveDependencies(plugins *Plugins) (*Plugins, error) {
+	byRepo := make(map[string]Plugin)
+	var order []string
+	for _, p := range append(enabledPlugins(plugins.Start), enabledPlugins(plugins.Opt)...) {
+		byRepo[normalizeRepo(p.Repo)] = p
+		order = append(order, normalizeRepo(p.Repo))
+	}
+
+	// 未定義の依存先をstartに追加する
+	resolved := &Plugins{
+		Start: plugins.Start,
+		Opt:   plugins.Opt,
+	}
+	for _, p := range append(enabledPlugins(plugins.Start), enabledPlugins(plugins.Opt)...) {
+		for _, dep := range p.Depends {
+			repo := normalizeRepo(dep)
+			if _, ok := byRepo[repo]; ok {
+				continue
+			}
+			d, err := dependencyPlugin(repo, p)
+			if err != nil {
+				return nil, err
+			}
+			byRepo[repo] = d
+			order = append(order, repo)
+			resolved.Start = append(resolved.Start, d)
+		}
+	}
+
+	// 循環依存の検出と、依存先を先にインストールするための並べ替え
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(repo string, chain []string) error
+	visit = func(repo string, chain []string) error {
+		switch state[repo] {
+		case visiting:
+			return fmt.Errorf("循環依存があります: %s", strings.Join(append(chain, repo), " -> "))
+		case visited:
+			return nil
+		}
+		state[repo] = visiting
+		for _, dep := range byRepo[repo].Depends {
+			if err := visit(normalizeRepo(dep), append(chain, repo)); err != nil {
+				return err
+			}
+		}
+		state[repo] = visited
+		return nil
+	}
+	for _, repo := range order {
+		if err := visit(repo, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	resolved.Start = sortByDependency(resolved.Start, byRepo)
+	resolved.Opt = sortByDependency(resolved.Opt, byRepo)
+	return resolved, nil
+}
+
+// 同じグループ内で依存先が先に来るように並べ替える
+// 循環依存が無いことは事前に確認しておくこと
+func sortByDependency(plugins []Plugin, byRepo map[string]Plugin) []Plugin {
+	inGroup := make(map[string]Plugin)
+	for _, p := range plugins {
+		inGroup[normalizeRepo(p.Repo)] = p
+	}
+
+	sorted := make([]Plugin, 0, len(plugins))
+	added := make(map[string]bool)
+	var visit func(repo string)
+	visit = func(repo string) {
+		if added[repo] {
+			return
+		}
+		added[repo] = true
+		for _, dep := range byRepo[repo].Depends {
+			visit(normalizeRepo(dep))
+		}
+		if p, ok := inGroup[repo]; ok {
+			sorted = append(sorted, p)
+		}
+	}
+	for _, p := range plugins {
+		visit(normalizeRepo(p.Repo))
+	}
+	return sorted
+}
+
+// デフォルトブランチを表すbranchの値
+const defaultBranchRef = "HEAD"
+
+// 自動で追加する依存プラグイン
+// 依存元と同じホストから取得する
+// tag/branchが分からないのでデフォルトブランチのアーカイブを取得する
+// ref名を指定せずにデフォルトブランチを取得できるのはGitHubだけなので、他のホストはエラーにする
+func dependencyPlugin(repo string, parent Plugin) (Plugin, error) {
+	d := Plugin{
+		Repo:       repo,
+		Host:       parent.Host,
+		Branch:     defaultBranchRef,
+		requiredBy: parent.Repo,
+	}
+	if host := cmp.Or(d.Host, "github.com"); host != "github.com" {
+		return Plugin{}, fmt.Errorf("%s: %sの依存先のデフォルトブランチを%sから取得できません。plugins.ymlにtag/branchを指定して追加してください", repo, parent.Repo, host)
+	}
+	return d, nil
+}
+
+func normalizeRepo(repo string) string {
+	return strings.Trim(strings.TrimSpace(repo), "/")
+}
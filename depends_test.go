@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDependencyPlugin(t *testing.T) {
+	d, err := dependencyPlugin("u/dep", Plugin{Repo: "u/parent", Tag: "v1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.requiredBy != "u/parent" {
+		t.Errorf("requiredBy = %s, want u/parent", d.requiredBy)
+	}
+	got, err := pluginUrl(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/u/dep/archive/HEAD.zip"; got != want {
+		t.Errorf("url = %s, want %s", got, want)
+	}
+}
+
+func TestDependencyPluginUnsupportedHost(t *testing.T) {
+	parent := Plugin{Repo: "u/parent", Host: "gitlab.com", Tag: "v1.0.0", Depends: []string{"u/dep"}}
+	_, err := resolveDependencies(&Plugins{Start: []Plugin{parent}})
+	if err == nil || !strings.Contains(err.Error(), "gitlab.com") {
+		t.Fatalf("err = %v, want gitlab.comから取得できないエラー", err)
+	}
+}
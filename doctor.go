@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// doctorの各チェック結果
+type checkResult struct {
+	level string
+	name  string
+	msg   string
+	// NG/WARNのときの対処法
+	hint string
+}
+
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkNG   = "NG"
+)
+
+// 環境を順にチェックして結果を表示する
+// NGが1つでもあれば終了コード1を返す
+func doctor(ctx context.Context, pluginsFilePath, packDir, packName string) error {
+	var results []checkResult
+
+	nvim, err := nvimPath()
+	if err != nil {
+		results = append(results, checkResult{checkNG, "nvim", err.Error(), "nvimをインストールしてPATHに追加するか、NVIM_BINで実行ファイルを指定してください"})
+	} else {
+		results = append(results, checkResult{checkOK, "nvim", nvim, ""})
+	}
+
+	// syncと同じ順序でpackディレクトリを決める
+	packPath := cmp.Or(packDir, os.Getenv("TTVPACK_PACK_DIR"))
+	switch {
+	case packPath != "":
+		results = append(results, checkResult{checkOK, "packpath", packPath + " (指定)", ""})
+	case nvim == "":
+		packPath, _ = defaultPackDir(packName)
+		results = append(results, checkResult{checkWarn, "packpath", "nvimが見つからないため標準のパスを使います: " + packPath, "--pack-dirで明示的に指定することもできます"})
+	default:
+		dir, err := getPackDir(packName)
+		if err != nil {
+			packPath, _ = defaultPackDir(packName)
+			results = append(results, checkResult{checkWarn, "packpath", err.Error() + "（標準のパスを使います: " + packPath + "）", "nvim --headless -c 'echo &packpath' -c qa が動くか確認してください"})
+		} else {
+			packPath = dir
+			results = append(results, checkResult{checkOK, "packpath", packPath, ""})
+		}
+	}
+	if packPath != "" {
+		results = append(results, checkWritable(packPath))
+	}
+
+	results = append(results, checkPluginsFile(pluginsFilePath))
+	results = append(results, checkNetwork(ctx))
+
+	// NGは--quietでも表示し、WARNとNGは標準エラー出力に出す
+	failed := false
+	for _, r := range results {
+		printf := logger.Successf
+		switch r.level {
+		case checkWarn:
+			printf = logger.Warnf
+		case checkNG:
+			printf = logger.Errorf
+			failed = true
+		}
+		printf("[%-4s] %s: %s", r.level, r.name, r.msg)
+		if r.hint != "" {
+			printf("       -> %s", r.hint)
+		}
+	}
+
+	if failed {
+		return exitCodeError(1)
+	}
+	return nil
+}
+
+func checkPluginsFile(pluginsFilePath string) checkResult {
+	if _, err := os.Stat(pluginsFilePath); errors.Is(err, fs.ErrNotExist) {
+		return checkResult{checkNG, "plugins.yml", pluginsFilePath + " がありません", "ttvpack initで雛形を作成してください"}
+	}
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return checkResult{checkNG, "plugins.yml", err.Error(), "エラー箇所を修正してください"}
+	}
+	msg := fmt.Sprintf("%s (start: %d件、opt: %d件)", pluginsFilePath, len(plugins.Start), len(plugins.Opt))
+	return checkResult{checkOK, "plugins.yml", msg, ""}
+}
+
+// packディレクトリがまだ無い場合は、作成先となる最も近い既存の親ディレクトリで確認する
+func checkWritable(packPath string) checkResult {
+	dir := packPath
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	f, err := os.CreateTemp(dir, ".ttvpack-doctor-*")
+	if err != nil {
+		return checkResult{checkNG, "書き込み権限", err.Error(), dir + " の権限を確認してください"}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return checkResult{checkOK, "書き込み権限", dir, ""}
+}
+
+// urlで取得するプラグインだけならGitHubに到達できなくても動くのでWARNにする
+func checkNetwork(ctx context.Context) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	const u = "https://github.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return checkResult{checkWarn, "ネットワーク", err.Error(), ""}
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return checkResult{checkWarn, "ネットワーク", err.Error(), "ネットワーク接続とプロキシ設定（HTTPS_PROXY）を確認してください"}
+	}
+	resp.Body.Close()
+	return checkResult{checkOK, "ネットワーク", fmt.Sprintf("%s (status %d)", u, resp.StatusCode), ""}
+}
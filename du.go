@@ -0,0 +1,98 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+)
+
+// duコマンドの1行分
+type duEntry struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Size int64  `json:"size"`
+}
+
+// duコマンドのJSON出力
+type duReport struct {
+	Plugins []duEntry `json:"plugins"`
+	Total   int64     `json:"total"`
+}
+
+// インストール済みプラグインのディスク使用量を降順で表示する
+func du(packPath string, args []string) error {
+	flags := flag.NewFlagSet("du", flag.ContinueOnError)
+	top := flags.Int("top", 0, "上位N件だけを表示する（0なら全件）")
+	jsonOutput := flags.Bool("json", false, "JSONで出力する")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report := duReport{Plugins: []duEntry{}}
+	for _, kind := range []string{"start", "opt"} {
+		dir := filepath.Join(packPath, kind)
+		names, err := listDirNames(dir)
+		if err != nil {
+			return err
+		}
+		for name := range names {
+			size, err := dirSize(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			report.Plugins = append(report.Plugins, duEntry{Name: name, Kind: kind, Size: size})
+			report.Total += size
+		}
+	}
+
+	// サイズが同じ場合も表示順が変わらないよう名前でも並べる
+	slices.SortFunc(report.Plugins, func(a, b duEntry) int {
+		if c := cmp.Compare(b.Size, a.Size); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	if *top > 0 && len(report.Plugins) > *top {
+		report.Plugins = report.Plugins[:*top]
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tKIND\tNAME")
+	for _, e := range report.Plugins {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", formatBytes(e.Size), e.Kind, e.Name)
+	}
+	fmt.Fprintf(w, "%s\t\t合計\n", formatBytes(report.Total))
+	return w.Flush()
+}
+
+// ディレクトリ以下の通常ファイルのサイズを合計する
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
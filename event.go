@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	// syncコマンドを実装する関数syncと名前が衝突するので別名で読み込む
+	gosync "sync"
+)
+
+// sync/updateの処理の段階
+type EventKind int
+
+const (
+	// プラグインのインストールを開始した（Index/Totalに全体での番号と件数が入る）
+	EventInstallStart EventKind = iota
+	// update時にプラグインの再取得を開始した（Index/Totalに全体での番号と件数が入る）
+	EventUpdateStart
+	// ダウンロードを開始した（途中から再開する場合はBytesに取得済みのサイズが入る）
+	EventDownloadStart
+	// ダウンロード中（Bytes/TotalBytesに進捗が入る。TotalBytesが不明な場合は0）
+	EventDownloadProgress
+	// ダウンロードが完了した
+	EventDownloadDone
+	// アーカイブの展開を開始した
+	EventExtractStart
+	// アーカイブの展開が完了した（Files/Bytesに展開したファイル数とサイズが入る）
+	EventExtractDone
+	// プラグインを設置した（シンボリックリンクの場合はDetailにリンク先が入る）
+	EventInstalled
+	// プラグインを削除した
+	EventRemoved
+	// インストールをスキップした（Detailに理由が入る）
+	EventSkipped
+	// プラグインの処理に失敗した（Errに理由が入る）
+	EventError
+)
+
+var eventKindNames = [...]string{
+	EventInstallStart:     "install_start",
+	EventUpdateStart:      "update_start",
+	EventDownloadStart:    "download_start",
+	EventDownloadProgress: "download_progress",
+	EventDownloadDone:     "download_done",
+	EventExtractStart:     "extract_start",
+	EventExtractDone:      "extract_done",
+	EventInstalled:        "installed",
+	EventRemoved:          "removed",
+	EventSkipped:          "skipped",
+	EventError:            "error",
+}
+
+func (k EventKind) String() string {
+	if k < 0 || int(k) >= len(eventKindNames) {
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+	return eventKindNames[k]
+}
+
+// スキップの理由
+const (
+	skipDetailInstalled = "installed"
+	skipDetailPinned    = "pinned"
+	skipDetailOffline   = "offline"
+	// update時に取得したアーカイブが既存のものと同じだった
+	skipDetailUnchanged = "unchanged"
+)
+
+// sync/updateの各段階で発行されるイベント
+// 表示は購読側に任せ、処理側はイベントを発行するだけにする
+type Event struct {
+	// ディレクトリ名
+	Plugin string
+	Kind   EventKind
+	Repo   string
+
+	Index int
+	Total int
+
+	Bytes      int64
+	TotalBytes int64
+	Files      int
+
+	Detail string
+	Err    error
+}
+
+// ctxにはイベントを発行したプラグインの処理のcontextが渡される
+type eventHandler func(ctx context.Context, e Event)
+
+// イベントの購読者の一覧
+// 並行にインストールしている場合は複数のgoroutineから同時に通知されるので、
+// 購読者はgoroutine安全にすること
+type eventBus struct {
+	mu       gosync.Mutex
+	handlers []eventHandler
+}
+
+var events = &eventBus{}
+
+// 購読を開始し、購読をやめる関数を返す
+func (b *eventBus) subscribe(h eventHandler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+	index := len(b.handlers) - 1
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.handlers[index] = nil
+	}
+}
+
+// 購読者の処理中にロックを持ち続けると、他のプラグインの処理や購読の解除が待たされるので、
+// 購読者の一覧を複製してからロックの外で呼ぶ
+func (b *eventBus) emit(ctx context.Context, e Event) {
+	b.mu.Lock()
+	handlers := slices.Clone(b.handlers)
+	b.mu.Unlock()
+	for _, h := range handlers {
+		if h != nil {
+			h(ctx, e)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 購読者の処理中はロックを持たないので、購読者の中から購読を解除できる
+func TestEmitReleasesLockDuringHandlers(t *testing.T) {
+	b := &eventBus{}
+	var unsubscribe func()
+	called := 0
+	unsubscribe = b.subscribe(func(ctx context.Context, e Event) {
+		called++
+		unsubscribe()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.emit(context.Background(), Event{Kind: EventInstalled})
+		b.emit(context.Background(), Event{Kind: EventInstalled})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("購読者の処理中にロックを持ち続けています")
+	}
+	if called != 1 {
+		t.Errorf("called = %d, want 1", called)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// url/mirror_url/repo/tag/branchとheadersの値の${VAR}を環境変数で展開する
+// 未定義の変数は空文字にせずエラーにする
+func expandPluginsEnv(plugins *Plugins) error {
+	var errs []error
+	expand := func(kind string, list []Plugin) {
+		for i := range list {
+			p := &list[i]
+			for _, field := range []*string{&p.Url, &p.MirrorUrl, &p.Repo, &p.Tag, &p.Branch} {
+				expanded, err := expandEnv(*field)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s[%d]: %w", kind, i, err))
+					continue
+				}
+				*field = expanded
+			}
+			for key, value := range p.Headers {
+				expanded, err := expandEnv(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s[%d]: headers.%s: %w", kind, i, key, err))
+					continue
+				}
+				p.Headers[key] = expanded
+			}
+		}
+	}
+	expand("start", plugins.Start)
+	expand("opt", plugins.Opt)
+	return errors.Join(errs...)
+}
+
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("未定義の環境変数です: %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// 並行処理全体を止めるべき致命的なエラー
+// 認証の失敗など、他のプラグインを続けても同じように失敗するものに使う
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.err
+}
+
+// 致命的なエラーかどうか
+// ディスクフルや書き込み権限が無い場合も、残りのプラグインで同じように失敗するので致命的とみなす
+// ネットワークエラーや404、sha256の不一致などはそのプラグインだけの問題なので致命的ではない
+func isFatal(err error) bool {
+	var fatal *fatalError
+	return errors.As(err, &fatal) ||
+		errors.Is(err, syscall.ENOSPC) ||
+		errors.Is(err, syscall.EROFS) ||
+		errors.Is(err, fs.ErrPermission)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-yaml"
+)
+
+// plugins.ymlを正規形（2スペースインデント、キー順はPluginのフィールド順）に整形する
+// コメントは元の要素に付け直して保持する（空行は詰める）
+// --check時は書き換えず、整形が必要なら終了コード1を返す
+func format(pluginsFilePath string, args []string) error {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	check := flags.Bool("check", false, "整形が必要かどうかだけを判定する")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	// includeや環境変数は展開せず、ファイルに書かれた内容だけを整形する
+	plugins, err := readPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	cm := yaml.CommentMap{}
+	if err := yaml.UnmarshalWithOptions(data, &Plugins{}, yaml.CommentToMap(cm)); err != nil {
+		return err
+	}
+	formatted, err := marshalPlugins(plugins, cm)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(data, formatted) {
+		return nil
+	}
+	if *check {
+		fmt.Fprintf(os.Stderr, "整形が必要です: %s\n", pluginsFilePath)
+		return exitCodeError(1)
+	}
+	if err := writePluginsFile(pluginsFilePath, formatted); err != nil {
+		return err
+	}
+	logger.Infof("formatted %s", pluginsFilePath)
+	return nil
+}
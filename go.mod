@@ -3,3 +3,9 @@ module ttvpack
 go 1.23.4
 
 require github.com/goccy/go-yaml v1.17.1
+
+require (
+	golang.org/x/sync v0.10.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
+)
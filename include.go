@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+)
+
+const (
+	// 同名repoが複数ファイルに現れたらエラーにする（デフォルト）
+	duplicateError = "error"
+	// 同名repoは後に読み込んだものを優先する
+	duplicateOverride = "override"
+)
+
+// includeで指定されたファイルを再帰的に読み込み、start/optをマージする
+// includeしたファイルを先に、メインファイルのエントリを最後にマージするので
+// overrideの場合はメインファイルの記述が優先される
+func readPluginsWithIncludes(path string) (*Plugins, error) {
+	root, err := readPlugins(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := root.OnDuplicate
+	switch policy {
+	case "":
+		policy = duplicateError
+	case duplicateError, duplicateOverride:
+	default:
+		return nil, fmt.Errorf("%s: on_duplicateには%sか%sを指定してください: %s", path, duplicateError, duplicateOverride, policy)
+	}
+
+	merged := &Plugins{}
+	origins := make(map[string]string)
+	visiting := make(map[string]bool)
+	if err := mergeIncludes(merged, origins, visiting, path, root, policy); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func mergeIncludes(merged *Plugins, origins map[string]string, visiting map[string]bool, path string, plugins *Plugins, policy string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if visiting[abs] {
+		return fmt.Errorf("includeが循環しています: %s", path)
+	}
+	visiting[abs] = true
+	defer delete(visiting, abs)
+
+	// includeのパスはそれを書いたファイルからの相対で解決する
+	for _, include := range plugins.Include {
+		includePath := include
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+		included, err := readPlugins(includePath)
+		if err != nil {
+			return err
+		}
+		if err := mergeIncludes(merged, origins, visiting, includePath, included, policy); err != nil {
+			return err
+		}
+	}
+
+	merge := func(list *[]Plugin, entries []Plugin) error {
+		for _, p := range entries {
+			repo := normalizeRepo(p.Repo)
+			if origin, ok := origins[repo]; ok {
+				// on_duplicateは別ファイル間の優先順位の指定なので、同じファイル内の重複は常にエラーにする
+				if origin == path {
+					return fmt.Errorf("%s: %sが複数回定義されています（startとoptの両方に書かれていないか確認してください）", path, p.Repo)
+				}
+				if policy == duplicateError {
+					return fmt.Errorf("%sが複数のファイルに定義されています: %s, %s", p.Repo, origin, path)
+				}
+				removeRepo := func(q Plugin) bool { return normalizeRepo(q.Repo) == repo }
+				merged.Start = slices.DeleteFunc(merged.Start, removeRepo)
+				merged.Opt = slices.DeleteFunc(merged.Opt, removeRepo)
+			}
+			origins[repo] = path
+			p.sourceDir = filepath.Dir(path)
+			*list = append(*list, p)
+		}
+		return nil
+	}
+	if err := merge(&merged.Start, plugins.Start); err != nil {
+		return err
+	}
+	return merge(&merged.Opt, plugins.Opt)
+}
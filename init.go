@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const pluginsTemplate = `# ttvpackのプラグイン設定
+#
+# start: 起動時に自動で読み込まれるプラグイン
+# opt:   :packadd で手動で読み込むプラグイン
+#
+# 各エントリには repo と tag/branch のどちらかを指定します。
+# url を省略すると GitHub のアーカイブURLが自動生成されます。
+
+start:
+#  - repo: username/repo1
+#    tag: v1.0.0
+#  - repo: username/repo2
+#    branch: main
+
+opt:
+#  - repo: username/repo3
+#    branch: main
+#    url: https://github.com/username/repo3/archive/refs/heads/main.zip
+`
+
+// plugins.ymlの雛形を生成する
+func initPlugins(pluginsFilePath string, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	force := flags.Bool("force", false, "既存のplugins.ymlを上書きする")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(pluginsFilePath); err == nil {
+		if !*force {
+			return fmt.Errorf("%s は既に存在します。上書きする場合は --force を指定してください。", pluginsFilePath)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(pluginsFilePath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(pluginsFilePath, []byte(pluginsTemplate), 0644); err != nil {
+		return err
+	}
+	logger.Infof("created: %s", pluginsFilePath)
+	return nil
+}
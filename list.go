@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+)
+
+// listコマンドの1行分
+type listEntry struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Kind   string `json:"kind"`
+	// plugins.ymlに存在しないディレクトリの場合は空
+	Group  string `json:"group,omitempty"`
+	Status string `json:"status"`
+	// .ttvpack.jsonから読み取った、実際にインストールされているバージョン
+	Installed string `json:"installed,omitempty"`
+}
+
+const (
+	statusInstalled    = "installed"
+	statusNotInstalled = "not installed"
+	statusOrphan       = "orphan"
+)
+
+// plugins.ymlの定義と実際のpackディレクトリを突き合わせて一覧表示する
+func list(pluginsFilePath, packPath string, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	jsonOutput := flags.Bool("json", false, "JSON配列で出力する")
+	groupName := flags.String("group", "", "groupフィールドが一致するプラグインだけを表示する")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	if err := resolveLockedTags(pluginsFilePath, plugins); err != nil {
+		return err
+	}
+
+	entries, err := makeListEntries(packPath, plugins)
+	if err != nil {
+		return err
+	}
+	if *groupName != "" {
+		entries = slices.DeleteFunc(entries, func(e listEntry) bool { return e.Group != *groupName })
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tVERSION\tINSTALLED\tKIND\tGROUP\tSTATUS")
+	for _, e := range entries {
+		version := e.Tag
+		if version == "" {
+			version = e.Branch
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Repo, version, e.Installed, e.Kind, e.Group, e.Status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	printGroupCounts(entries)
+	return nil
+}
+
+// groupを使っている場合は、グループごとの件数を表示する
+func printGroupCounts(entries []listEntry) {
+	total := make(map[string]int)
+	installed := make(map[string]int)
+	for _, e := range entries {
+		if e.Group == "" {
+			continue
+		}
+		total[e.Group]++
+		if e.Status == statusInstalled {
+			installed[e.Group]++
+		}
+	}
+	if len(total) < 2 {
+		return
+	}
+	fmt.Println()
+	for _, name := range slices.Sorted(maps.Keys(total)) {
+		fmt.Printf("%s: %d件（インストール済み %d件）\n", name, total[name], installed[name])
+	}
+}
+
+func makeListEntries(packPath string, plugins *Plugins) ([]listEntry, error) {
+	entries := []listEntry{}
+	for _, group := range pluginGroups(packPath, plugins) {
+		installed, err := listDirNames(group.dir)
+		if err != nil {
+			return nil, err
+		}
+
+		defined := make(map[string]bool)
+		for _, p := range group.plugins {
+			dirName := makeDirName(p)
+			defined[dirName] = true
+
+			entry := listEntry{
+				Repo:   p.Repo,
+				Tag:    p.Tag,
+				Branch: p.Branch,
+				Kind:   group.kind,
+				Group:  p.group(),
+				Status: statusNotInstalled,
+			}
+			if installed[dirName] {
+				entry.Status = statusInstalled
+				entry.Installed = installedVersion(filepath.Join(group.dir, dirName))
+			}
+			entries = append(entries, entry)
+		}
+
+		// plugins.ymlに存在しないディレクトリ
+		for _, name := range slices.Sorted(maps.Keys(installed)) {
+			if !defined[name] {
+				entries = append(entries, listEntry{
+					Repo:      name,
+					Kind:      group.kind,
+					Status:    statusOrphan,
+					Installed: installedVersion(filepath.Join(group.dir, name)),
+				})
+			}
+		}
+	}
+	return entries, nil
+}
+
+// メタ情報が無い場合は空文字を返す
+func installedVersion(dir string) string {
+	meta, ok := readPluginMeta(dir)
+	if !ok {
+		return ""
+	}
+	return meta.version()
+}
+
+// ディレクトリ直下のディレクトリ名の集合を返す
+// ディレクトリが存在しない場合は空とみなす
+func listDirNames(dir string) (map[string]bool, error) {
+	paths, err := listDirEntries(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			names[filepath.Base(p)] = true
+		}
+	}
+	return names, nil
+}
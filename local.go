@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// trueの場合、ネットワークを使わずキャッシュとローカルのアーカイブだけでインストールする
+var offline = false
+
+var errOffline = errors.New("offlineモードのためダウンロードできません")
+
+// file://スキームのurlかどうか
+func isFileUrl(u string) bool {
+	return strings.HasPrefix(u, "file://")
+}
+
+// ./や../で始まる相対パスかどうか
+func isRelativePath(u string) bool {
+	u = filepath.ToSlash(u)
+	return strings.HasPrefix(u, "./") || strings.HasPrefix(u, "../")
+}
+
+// urlがfile://またはローカルのパスであれば、そのパスを返す
+func localPath(u string) (string, bool) {
+	if isFileUrl(u) {
+		p, err := fileUrlPath(u)
+		return p, err == nil
+	}
+	if filepath.IsAbs(u) || isRelativePath(u) {
+		return u, true
+	}
+	return "", false
+}
+
+// urlの相対パスを、そのエントリを書いたplugins.ymlのディレクトリからの相対として解決する
+// includeしたファイルのエントリはincludeしたファイルのディレクトリが基準になる
+func resolveLocalUrls(plugins *Plugins) {
+	for _, list := range [][]Plugin{plugins.Start, plugins.Opt} {
+		for i := range list {
+			if isRelativePath(list[i].Url) {
+				list[i].Url = filepath.Join(list[i].sourceDir, list[i].Url)
+			}
+		}
+	}
+}
+
+// file:///path/to.zip をローカルのパスにする
+func fileUrlPath(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	p := parsed.Path
+	// Windowsではfile:///C:/path の先頭のスラッシュを取り除く
+	if runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	if p == "" {
+		return "", fmt.Errorf("不正なfile URLです: %s", u)
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// ローカルのアーカイブをdestにコピーし、内容のSHA-256を返す
+func copyLocalArchive(u, dest string) (string, error) {
+	src, ok := localPath(u)
+	if !ok {
+		return "", fmt.Errorf("不正なfile URLです: %s", u)
+	}
+	sum, err := copyFileWithHash(src, dest)
+	if err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	if err := checkArchive(u, dest); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return sum, nil
+}
+
+// ネットワークを使わずにインストールできるかどうか
+func availableOffline(p Plugin) bool {
+	u, err := pluginUrl(p)
+	if err != nil {
+		return false
+	}
+	if _, ok := localPath(u); ok {
+		return true
+	}
+	cachePath, ok := pluginCachePath(p, u)
+	if !ok {
+		return false
+	}
+	_, err = os.Stat(cachePath)
+	return err == nil
+}
+
+// ローカルのディレクトリをプラグインとして設置する
+// symlink: trueならシンボリックリンクを張り、そうでなければコピーする
+func installLocalDir(ctx context.Context, dir string, p Plugin, u, src string) (lockedPlugin, error) {
+	dirName := makeDirName(p)
+	expandedPath := filepath.Join(dir, dirName)
+
+	if p.Symlink {
+		// 元のディレクトリを書き換えてしまうので、パッチは当てない
+		if len(p.Patches) > 0 {
+			return lockedPlugin{}, fmt.Errorf("%s: symlinkのプラグインにはパッチを適用できません", p.Repo)
+		}
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return lockedPlugin{}, err
+		}
+		// シンボリックリンクの場合はRemoveAllでもリンク自体しか消えない
+		if err := os.RemoveAll(expandedPath); err != nil {
+			return lockedPlugin{}, err
+		}
+		if err := os.Symlink(abs, expandedPath); err != nil {
+			return lockedPlugin{}, err
+		}
+		verifyCheckFile(ctx, abs, p)
+		events.emit(ctx, Event{Plugin: dirName, Kind: EventInstalled, Repo: p.Repo, Detail: abs})
+		return lockedPlugin{Repo: p.Repo, Tag: p.Tag, Branch: p.Branch, Url: u}, nil
+	}
+
+	// アーカイブと同様、一時ディレクトリにコピーしてから最終パスへ移動する
+	tmpDir, err := os.MkdirTemp(dir, "."+dirName+"-*")
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, extractDirMode); err != nil {
+		return lockedPlugin{}, err
+	}
+	if err := copyDir(ctx, src, tmpDir); err != nil {
+		return lockedPlugin{}, err
+	}
+	rootDir, err := pluginRoot(tmpDir, p)
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+	if err := applyPatches(ctx, rootDir, p); err != nil {
+		return lockedPlugin{}, err
+	}
+	verifyCheckFile(ctx, rootDir, p)
+	meta := pluginMeta{
+		Repo:        p.Repo,
+		Tag:         p.Tag,
+		Branch:      p.Branch,
+		Commit:      p.Commit,
+		Url:         u,
+		Preremove:   p.Preremove,
+		InstalledAt: time.Now(),
+	}
+	if err := writePluginMeta(rootDir, meta); err != nil {
+		return lockedPlugin{}, err
+	}
+
+	if _, err := replacePluginDir(rootDir, expandedPath); err != nil {
+		return lockedPlugin{}, err
+	}
+	events.emit(ctx, Event{Plugin: dirName, Kind: EventInstalled, Repo: p.Repo})
+	return lockedPlugin{Repo: p.Repo, Tag: p.Tag, Branch: p.Branch, Commit: p.Commit, Url: u}, nil
+}
+
+// srcの中身をdestにコピーする
+// 開発中のディレクトリを想定しているので.gitは除く
+func copyDir(ctx context.Context, src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		target := filepath.Join(dest, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, extractDirMode)
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return copyFile(path, target, extractFileMode(info.Mode()))
+		default:
+			ctxLogger(ctx).Debugf("  skip %s", rel)
+			return nil
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalUrlRelativeToIncludedFile(t *testing.T) {
+	path := writeTestPluginsFile(t, `
+include:
+  - sub/plugins.yml
+start:
+  - repo: u/main
+    url: ./archives/main.zip
+`)
+	dir := filepath.Dir(path)
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "plugins.yml"), []byte(`
+start:
+  - repo: u/sub
+    url: ./archives/sub.zip
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plugins, err := loadPlugins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"u/main": filepath.Join(dir, "archives", "main.zip"),
+		"u/sub":  filepath.Join(sub, "archives", "sub.zip"),
+	}
+	for _, p := range plugins.Start {
+		if p.Url != want[p.Repo] {
+			t.Errorf("%s: url = %s, want %s", p.Repo, p.Url, want[p.Repo])
+		}
+	}
+}
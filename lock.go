@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// plugins.lockに記録するプラグインの取得結果
+type lockedPlugin struct {
+	Repo   string `yaml:"repo"`
+	Kind   string `yaml:"kind"`
+	Tag    string `yaml:"tag,omitempty"`
+	Branch string `yaml:"branch,omitempty"`
+	Commit string `yaml:"commit,omitempty"`
+	Url    string `yaml:"url"`
+	Sha256 string `yaml:"sha256,omitempty"`
+	// tagをsemverの制約から解決した場合の制約
+	Constraint string `yaml:"constraint,omitempty"`
+	// plugins.ymlのエントリのハッシュ。次回のsyncで、定義が変わっていないプラグインを見分けるのに使う
+	EntryHash string `yaml:"entry_hash,omitempty"`
+}
+
+type lockFile struct {
+	Plugins []lockedPlugin `yaml:"plugins"`
+}
+
+// plugins.ymlと同じ場所のplugins.lockを返す
+func lockFilePath(pluginsFilePath string) string {
+	ext := filepath.Ext(pluginsFilePath)
+	return strings.TrimSuffix(pluginsFilePath, ext) + ".lock"
+}
+
+// ロックファイルを読み込む
+// ファイルが存在しない場合はnilを返す
+func readLockFile(path string) (*lockFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lock lockFile
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// 差分が出にくいよう、種別とrepoでソートして書き出す
+func writeLockFile(path string, lock *lockFile) error {
+	slices.SortFunc(lock.Plugins, func(a, b lockedPlugin) int {
+		return cmp.Or(cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Repo, b.Repo))
+	})
+
+	data, err := yaml.MarshalWithOptions(lock, yaml.Indent(2), yaml.IndentSequence(true))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// plugins.ymlのエントリに対応するロック情報を探す
+// tag/branch/commitが変わっている場合はロックが古いとみなして一致させない
+func (l *lockFile) find(kind string, p Plugin) (lockedPlugin, bool) {
+	if l == nil {
+		return lockedPlugin{}, false
+	}
+	for _, locked := range l.Plugins {
+		if p.Commit != "" && locked.Commit != p.Commit {
+			continue
+		}
+		if locked.Kind == kind && locked.Repo == p.Repo && locked.Tag == p.Tag && locked.Branch == p.Branch {
+			return locked, true
+		}
+	}
+	return lockedPlugin{}, false
+}
+
+// ロックファイルに記録されたurlとsha256でプラグインを上書きする
+func (l *lockFile) apply(kind string, plugins []Plugin) []Plugin {
+	applied := make([]Plugin, len(plugins))
+	for i, p := range plugins {
+		if locked, ok := l.find(kind, p); ok {
+			p.Url = locked.Url
+			p.Sha256 = locked.Sha256
+		}
+		applied[i] = p
+	}
+	return applied
+}
+
+// 今回インストールしたものと既存のロック情報から新しいロックファイルを作る
+// verifiedには、インストールはしなかったがインストール済みであることを確認したプラグインを渡す
+func makeLockFile(plugins *Plugins, old *lockFile, installed, verified []lockedPlugin) *lockFile {
+	lock := &lockFile{}
+	add := func(kind string, list []Plugin) {
+		for _, p := range list {
+			lock.Plugins = append(lock.Plugins, lockEntry(kind, p, old, installed, verified))
+		}
+	}
+	add("start", enabledPlugins(plugins.Start))
+	add("opt", enabledPlugins(plugins.Opt))
+	return lock
+}
+
+func lockEntry(kind string, p Plugin, old *lockFile, installed, verified []lockedPlugin) lockedPlugin {
+	match := func(l lockedPlugin) bool {
+		return l.Kind == kind && l.Repo == p.Repo
+	}
+	hash := entryHash(p)
+	var locked lockedPlugin
+	// エントリのハッシュは、今回インストールしたか確認したプラグインと、前回から変わっていないプラグインにだけ記録する
+	// インストールに失敗したプラグインに記録すると、次回以降のsyncで入れ直されなくなる
+	current := slices.ContainsFunc(verified, match)
+	if i := slices.IndexFunc(installed, match); i >= 0 {
+		locked = installed[i]
+		current = true
+	} else if found, ok := old.find(kind, p); ok {
+		locked = found
+		current = current || found.EntryHash == hash
+	} else {
+		u, _ := pluginUrl(p)
+		locked = lockedPlugin{
+			Repo:   p.Repo,
+			Kind:   kind,
+			Tag:    p.Tag,
+			Branch: p.Branch,
+			Url:    u,
+			Sha256: p.Sha256,
+		}
+	}
+	locked.Constraint = p.tagConstraint
+	locked.EntryHash = ""
+	if current {
+		locked.EntryHash = hash
+	}
+	return locked
+}
+
+// plugins.ymlに書かれたエントリの内容から求めるハッシュ
+// tagは解決後のタグではなく、書かれた制約のままで求める
+func entryHash(p Plugin) string {
+	p.Tag = cmp.Or(p.tagConstraint, p.Tag)
+	// 非公開のフィールドは含まれない
+	data, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ロックファイルと比べて、前回のsyncからエントリが変わっていないプラグインに印を付ける
+// 印を付けたプラグインは、ディレクトリがあればメタ情報を読まずにインストール済みとみなす
+func markUnchanged(plugins *Plugins, lock *lockFile) int {
+	if lock == nil {
+		return 0
+	}
+	count := 0
+	mark := func(kind string, list []Plugin) {
+		for i := range list {
+			p := &list[i]
+			hash := entryHash(*p)
+			p.unchanged = slices.ContainsFunc(lock.Plugins, func(l lockedPlugin) bool {
+				return l.Kind == kind && l.Repo == p.Repo && l.Tag == p.Tag && l.EntryHash != "" && l.EntryHash == hash
+			})
+			if p.unchanged {
+				count++
+			}
+		}
+	}
+	mark("start", plugins.Start)
+	mark("opt", plugins.Opt)
+	return count
+}
+
+// GitHubのアーカイブはzipのコメントにcommit hashが入っているので、それを取り出す
+func zipCommit(path string) string {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+
+	comment := strings.TrimSpace(r.Comment)
+	if len(comment) != 40 {
+		return ""
+	}
+	if _, err := hex.DecodeString(comment); err != nil {
+		return ""
+	}
+	return comment
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// ログファイルがこのサイズを超えたらローテーションする
+	maxLogSize = 5 << 20
+	// ローテーションで残す古いログの数（ttvpack.log.1〜ttvpack.log.3）
+	maxLogBackups = 3
+)
+
+// $XDG_STATE_HOME/ttvpack/ttvpack.log を返す
+// XDG_STATE_HOMEが無ければ~/.local/state、WindowsではLOCALAPPDATAを使う
+func defaultLogPath() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		if runtime.GOOS == "windows" {
+			dir = os.Getenv("LOCALAPPDATA")
+		}
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			dir = filepath.Join(home, ".local", "state")
+		}
+	}
+	return filepath.Join(dir, "ttvpack", "ttvpack.log"), nil
+}
+
+// ログファイルを開き、loggerに設定する
+// 書き込めなくてもコマンド自体は続行できるので、エラーは呼び出し側で警告に留める
+func openLogFile(path string, args []string) error {
+	if path == "" {
+		var err error
+		path, err = defaultLogPath()
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	rotateLogFile(path)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	logger.setFile(f)
+	// どのコマンドのログか分かるよう、最初に引数を記録する
+	logger.writeFile("INFO", "$ ttvpack %s (pid %d)", strings.Join(args, " "), os.Getpid())
+	return nil
+}
+
+// サイズの上限を超えていれば、ttvpack.log → ttvpack.log.1 → ttvpack.log.2 … とずらす
+func rotateLogFile(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() < maxLogSize {
+		return
+	}
+	for i := maxLogBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	os.Rename(path, path+".1")
+}
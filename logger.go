@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	gosync "sync"
+
+	"golang.org/x/term"
+)
+
+// ログの出力量
+type logLevel int
+
+const (
+	// エラー以外を出力しない
+	levelQuiet logLevel = iota
+	// 要約のみ出力する
+	levelNormal
+	// zipエントリの展開などの詳細も出力する
+	levelVerbose
+)
+
+const (
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// trueの場合、TTYでも色を付けない（--no-color）
+var noColor = false
+
+// 出力先がTTYで、NO_COLORや--no-colorで無効化されていなければ色を付ける
+// CIのログなどに制御文字を混ぜないため
+func colorEnabled(f *os.File) bool {
+	return !noColor && os.Getenv("NO_COLOR") == "" && isTerminal(f)
+}
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// 全てのログ出力を通すLogger
+// log.Loggerを使うので並行ダウンロード中に呼んでも行が混ざらない
+type Logger struct {
+	level logLevel
+	// 通常のログの出力先（進捗表示もここに出す）
+	outFile  *os.File
+	out      *log.Logger
+	err      *log.Logger
+	outColor bool
+	errColor bool
+	// ログファイル（無効な場合はnil）
+	// ターミナルの出力レベルに関係なく、常に詳細レベルで記録する
+	file *log.Logger
+	// bufferedで作った場合の出力先と、flushで書き出す先（それ以外はnil）
+	buffer *logBuffer
+	parent *Logger
+}
+
+func newLogger(level logLevel) *Logger {
+	return &Logger{
+		level:    level,
+		outFile:  os.Stdout,
+		out:      log.New(os.Stdout, "", 0),
+		err:      log.New(os.Stderr, "", 0),
+		outColor: colorEnabled(os.Stdout),
+		errColor: colorEnabled(os.Stderr),
+	}
+}
+
+// 標準出力を機械向けの出力に使う場合に、全てのログを標準エラー出力へ回す
+func (l *Logger) useStderr() {
+	l.outFile = os.Stderr
+	l.out = l.err
+	l.outColor = l.errColor
+}
+
+// ログファイルにも書き出すようにする
+func (l *Logger) setFile(f *os.File) {
+	l.file = log.New(f, "", log.LstdFlags)
+}
+
+func (l *Logger) writeFile(level, format string, args ...any) {
+	if l.file != nil {
+		l.file.Printf(level+" "+format, args...)
+	}
+}
+
+func (l *Logger) printf(out *log.Logger, color string, enabled bool, format string, args ...any) {
+	if enabled {
+		format = color + format + colorReset
+	}
+	out.Printf(format, args...)
+}
+
+var logger = newLogger(levelNormal)
+
+// 並行インストール中のプラグインのログをためておくバッファ
+// 標準出力と標準エラー出力の順序を保ったまま、完了時にまとめて出力する
+type logBuffer struct {
+	mu    gosync.Mutex
+	lines []bufferedLine
+}
+
+type bufferedLine struct {
+	stderr bool
+	text   string
+}
+
+// log.Loggerの出力先にするio.Writer
+type logBufferWriter struct {
+	buffer *logBuffer
+	stderr bool
+}
+
+func (w logBufferWriter) Write(p []byte) (int, error) {
+	w.buffer.mu.Lock()
+	defer w.buffer.mu.Unlock()
+	w.buffer.lines = append(w.buffer.lines, bufferedLine{stderr: w.stderr, text: string(p)})
+	return len(p), nil
+}
+
+// 複数のプラグインのログがまとめて出力される際に、行が混ざらないようにするロック
+var flushLock gosync.Mutex
+
+// 出力をバッファにためるLoggerを作る
+// レベルや色、ログファイルは元のLoggerと同じものを使う
+func (l *Logger) buffered() *Logger {
+	buffer := &logBuffer{}
+	child := *l
+	child.out = log.New(logBufferWriter{buffer: buffer}, "", 0)
+	child.err = log.New(logBufferWriter{buffer: buffer, stderr: true}, "", 0)
+	child.buffer = buffer
+	child.parent = l
+	return &child
+}
+
+// bufferedでためたログを元の出力先にまとめて出力する
+func (l *Logger) flush() {
+	if l.buffer == nil {
+		return
+	}
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	l.buffer.mu.Lock()
+	lines := l.buffer.lines
+	l.buffer.lines = nil
+	l.buffer.mu.Unlock()
+	for _, line := range lines {
+		out := l.parent.out
+		if line.stderr {
+			out = l.parent.err
+		}
+		out.Print(strings.TrimSuffix(line.text, "\n"))
+	}
+}
+
+// 進捗表示の行を上書きできるかどうか
+// バッファする場合は後でまとめて出力するので、上書きはしない
+func (l *Logger) isTTY() bool {
+	return l.buffer == nil && isTerminal(l.outFile)
+}
+
+type loggerKey struct{}
+
+// プラグインごとのLoggerをcontextで渡す
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// contextにLoggerが無ければ共通のloggerを返す
+func ctxLogger(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// verbose時のみ出力する
+func (l *Logger) Debugf(format string, args ...any) {
+	l.writeFile("DEBUG", format, args...)
+	if l.level >= levelVerbose {
+		l.out.Printf(format, args...)
+	}
+}
+
+// quiet時以外に出力する
+func (l *Logger) Infof(format string, args ...any) {
+	l.writeFile("INFO", format, args...)
+	if l.level >= levelNormal {
+		l.out.Printf(format, args...)
+	}
+}
+
+// quiet時以外に緑で出力する
+func (l *Logger) Successf(format string, args ...any) {
+	l.writeFile("INFO", format, args...)
+	if l.level >= levelNormal {
+		l.printf(l.out, colorGreen, l.outColor, format, args...)
+	}
+}
+
+// quiet時以外に指定した色で出力する
+func (l *Logger) Colorf(color, format string, args ...any) {
+	l.writeFile("INFO", format, args...)
+	if l.level >= levelNormal {
+		l.printf(l.out, color, l.outColor, format, args...)
+	}
+}
+
+// quiet時以外に標準エラー出力へ黄色で出力する
+func (l *Logger) Warnf(format string, args ...any) {
+	l.writeFile("WARN", format, args...)
+	if l.level >= levelNormal {
+		l.printf(l.err, colorYellow, l.errColor, format, args...)
+	}
+}
+
+// 常に標準エラー出力へ赤で出力する
+func (l *Logger) Errorf(format string, args ...any) {
+	l.writeFile("ERROR", format, args...)
+	l.printf(l.err, colorRed, l.errColor, format, args...)
+}
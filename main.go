@@ -2,19 +2,35 @@ package main
 
 import (
 	"archive/zip"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/goccy/go-yaml"
+	"golang.org/x/sync/errgroup"
 )
 
 // ```plugins.yml
@@ -34,259 +50,1922 @@ import (
 
 type Plugin struct {
 	Repo string `yaml:"repo"`
-	Tag  string `yaml:"tag"`
-	Branch  string `yaml:"branch"`
-	Url  string `yaml:"url"`
+	// ディレクトリ名に使う名前（未指定の場合はrepoのベース名）
+	Name   string `yaml:"name,omitempty"`
+	Tag    string `yaml:"tag,omitempty"`
+	Branch string `yaml:"branch,omitempty"`
+	Commit string `yaml:"commit,omitempty"`
+	Url    string `yaml:"url,omitempty"`
+	// urlやGitHubからの取得に失敗した場合に使うミラー（同じ形式のアーカイブを指定する）
+	MirrorUrl string `yaml:"mirror_url,omitempty"`
+	Host      string `yaml:"host,omitempty"`
+	Sha256    string `yaml:"sha256,omitempty"`
+	// ダウンロード時に付けるHTTPヘッダ（社内サーバーの認証など）
+	// 値には${VAR}を書けるので、トークンはplugins.ymlに直書きせず環境変数から渡す
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Build   string            `yaml:"build,omitempty"`
+	// urlがローカルのディレクトリの場合、コピーせずにシンボリックリンクで設置する
+	Symlink bool `yaml:"symlink,omitempty"`
+	// インストール後にheadlessのnvimで実行するコマンド（TSUpdateなど）
+	PostinstallNvim string `yaml:"postinstall_nvim,omitempty"`
+	// アンインストール時にディレクトリを削除する前に実行するコマンド
+	Preremove string `yaml:"preremove,omitempty"`
+	// アーカイブ内でプラグインのルートとなるサブディレクトリ
+	Rtp string `yaml:"rtp,omitempty"`
+	// 展開後に存在するはずのファイル（plugin/foo.luaなど）。無ければ警告する
+	Check string `yaml:"check,omitempty"`
+	Pin   bool   `yaml:"pin,omitempty"`
+	// 用途別のグループ（lsp、uiなど）。start/optとは独立に指定でき、未指定はdefault
+	Group string `yaml:"group,omitempty"`
+	// 展開後に適用するパッチ（そのエントリを書いたplugins.ymlからの相対パス）
+	// パッチを当てたプラグインは再取得で上書きしないようpinと同じ扱いにする
+	Patches []string `yaml:"patches,omitempty"`
+	// 依存するプラグインのrepo
+	Depends []string `yaml:"depends,omitempty"`
+	// 未指定の場合は有効とみなすためポインタにする
+	Enabled *bool `yaml:"enabled,omitempty"`
+
+	// dependsによって自動で追加された場合の依存元
+	requiredBy string
+	// このエントリを書いたplugins.yml（includeされたファイルを含む）のディレクトリ
+	// urlとpatchesの相対パスはここを基準に解決する
+	sourceDir string
+	// tagにsemverの制約が書かれていた場合の元の制約（tagは解決後のタグに置き換わる）
+	tagConstraint string
+	// 前回のsyncからplugins.ymlのエントリが変わっていない
+	unchanged bool
+}
+
+// enabled: falseのプラグインはインストールせず、インストール済みなら削除する
+func (p Plugin) isEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// プラグインの名前
+// nameが指定されていればそれを、無ければrepoのベース名を使う
+func (p Plugin) name() string {
+	return cmp.Or(p.Name, path.Base(p.Repo))
+}
+
+// groupが未指定のプラグインのグループ
+const defaultGroup = "default"
+
+func (p Plugin) group() string {
+	return cmp.Or(p.Group, defaultGroup)
+}
+
+// 指定したグループのプラグインだけを残す
+func filterByGroup(groups []pluginGroup, name string) []pluginGroup {
+	filtered := make([]pluginGroup, len(groups))
+	for i, g := range groups {
+		g.plugins = slices.DeleteFunc(slices.Clone(g.plugins), func(p Plugin) bool { return p.group() != name })
+		filtered[i] = g
+	}
+	return filtered
+}
+
+// pinされているか、パッチを当てているため再取得しないかどうか
+func (p Plugin) pinned() bool {
+	return p.Pin || len(p.Patches) > 0
+}
+
+func enabledPlugins(plugins []Plugin) []Plugin {
+	return slices.DeleteFunc(slices.Clone(plugins), func(p Plugin) bool {
+		return !p.isEnabled()
+	})
 }
 
 type Plugins struct {
 	Start []Plugin `yaml:"start"`
 	Opt   []Plugin `yaml:"opt"`
+	// 他のplugins.ymlを読み込む（このファイルからの相対パス）
+	Include []string `yaml:"include,omitempty"`
+	// 同名repoが複数ファイルに現れた場合の扱い（error/override）
+	OnDuplicate string `yaml:"on_duplicate,omitempty"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		var code exitCodeError
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
+		logger.Errorf("エラー: %v", err)
+		os.Exit(1)
+	}
+}
+
+// エラーメッセージを出さずに終了コードだけを返すためのエラー
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func run() error {
+	// サブコマンドより前に指定する共通オプション
+	flags := flag.NewFlagSet("ttvpack", flag.ContinueOnError)
+	flags.Usage = printUsage
+	verbose := flags.Bool("verbose", false, "詳細なログを出力する")
+	quiet := flags.Bool("quiet", false, "エラー以外のログを出力しない")
+	configPath := flags.String("config", "", "plugins.ymlのパス")
+	packName := flags.String("pack-name", "", "packディレクトリ名（デフォルトはttpack）")
+	packDir := flags.String("pack-dir", "", "packディレクトリのパス（指定した場合はnvimからpackpathを取得しない）")
+	flags.BoolVar(&backupPluginsFile, "backup", false, "plugins.ymlを書き換える前に.bakを残す")
+	flags.IntVar(&backupGenerations, "backup-generations", backupGenerations, "plugins.ymlを書き換える前に残すバックアップの世代数（0で無効）")
+	flags.BoolVar(&noColor, "no-color", false, "色付きで出力しない")
+	logFile := flags.String("log-file", "", "ログファイルのパス（デフォルトは$XDG_STATE_HOME/ttvpack/ttvpack.log）")
+	noLog := flags.Bool("no-log", false, "ログファイルに書き出さない")
+	flags.Func("max-rate", "ダウンロード全体の帯域の上限（例: 2MB）", func(s string) error {
+		rate, err := parseByteSize(s)
+		if err != nil {
+			return err
+		}
+		downloadLimiter = newRateLimiter(rate)
+		return nil
+	})
+	// os.Args[0]はプログラム名なので、サブコマンドは2番目以降
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+
+	// --no-colorを反映するため、レベルの指定が無くても作り直す
+	switch {
+	case *verbose && *quiet:
+		return errors.New("--verboseと--quietは同時に指定できません。")
+	case *verbose:
+		logger = newLogger(levelVerbose)
+	case *quiet:
+		logger = newLogger(levelQuiet)
+	default:
+		logger = newLogger(levelNormal)
+	}
+	unsubscribe := events.subscribe(printEvent)
+	defer unsubscribe()
+	if !*noLog {
+		// 明示的に指定された場合だけ、開けなければ警告する
+		if err := openLogFile(*logFile, os.Args[1:]); err != nil && *logFile != "" {
+			logger.Warnf("ログファイルを開けませんでした: %v", err)
+		} else if err != nil {
+			logger.Debugf("ログファイルを開けませんでした: %v", err)
+		}
+	}
+
+	if flags.NArg() < 1 {
+		printUsage()
+		return errors.New("コマンドを指定してください。")
+	}
+	cmd, args := flags.Arg(0), flags.Args()[1:]
+
+	// SIGINTでダウンロードを中断する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// plugins.ymlの取得
+	// --configが指定されていれば自動解決はしない
+	pluginsFilePath := getPluginsFilePath()
+	if *configPath != "" {
+		var err error
+		pluginsFilePath, err = resolveConfigPath(*configPath, cmd != "init" && cmd != "doctor" && cmd != "version")
+		if err != nil {
+			return err
+		}
+	}
+	logger.Debugf("plugins: %s", pluginsFilePath)
+
+	// version、validate、restore、doctorはnvimやpackpathが取れない環境でも結果を出したいので先に処理する
+	if cmd == "version" {
+		printVersion()
+		return nil
+	}
+	if cmd == "validate" {
+		return validate(pluginsFilePath)
+	}
+	if cmd == "restore" {
+		return restore(pluginsFilePath, args)
+	}
+	if cmd == "doctor" {
+		return doctor(ctx, pluginsFilePath, *packDir, resolvePackName(*packName))
+	}
+
+	// packフォルダパスの取得
+	packPath, err := resolvePackDir(*packDir, resolvePackName(*packName))
+	if err != nil {
+		return err
+	}
+	logger.Debugf("pack: %s", packPath)
+
+	switch cmd {
+	case "init":
+		return initPlugins(pluginsFilePath, args)
+	case "add":
+		return add(ctx, pluginsFilePath, args)
+	case "rm":
+		return remove(pluginsFilePath, args)
+	case "sync":
+		return sync(ctx, pluginsFilePath, packPath, args)
+	case "list":
+		return list(pluginsFilePath, packPath, args)
+	case "status":
+		return status(pluginsFilePath, packPath)
+	case "clean":
+		return clean(ctx, pluginsFilePath, packPath, args)
+	case "cache":
+		return cache(args)
+	case "update":
+		return update(ctx, pluginsFilePath, packPath, args)
+	case "du":
+		return du(packPath, args)
+	case "fmt":
+		return format(pluginsFilePath, args)
+	case "outdated":
+		return outdated(ctx, pluginsFilePath, packPath)
+	default:
+		return errors.New("存在しないコマンドです。")
+	}
+}
+
+// --configで指定されたパスを実行ディレクトリ基準で絶対パスにする
+func resolveConfigPath(configPath string, mustExist bool) (string, error) {
+	abs, err := filepath.Abs(configPath)
+	if err != nil {
+		return "", err
+	}
+	if mustExist {
+		if _, err := os.Stat(abs); err != nil {
+			return "", fmt.Errorf("設定ファイルが見つかりません: %s", abs)
+		}
+	}
+	return abs, nil
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `使い方: ttvpack [options] <command> [arguments]
+
+コマンド:
+  init [--force]
+              plugins.ymlの雛形を生成する
+  add [--yes] [--verify] [--opt] <url|username/repo>
+              plugins.ymlにプラグインを追加する
+              --optを指定した場合は、startではなくoptに追加する（:packaddで読み込む前提）
+              --verifyを指定した場合は、アーカイブのURLが存在するか確認してから追加する
+              username/repoの場合は最新のreleaseタグ（無ければデフォルトブランチ）を使う
+  rm <name|repo>
+              plugins.ymlからプラグインを削除する（コメントは保持する）
+              インストール済みのディレクトリは次のsyncで削除される
+  sync [--dry-run] [--locked] [--no-cache] [--no-symlinks] [--jobs N] [--extract-jobs N]
+        [--only start|opt] [--group name] [--strict-host] [--ignore-build-errors] [--keep-going]
+        [--force] [--ignore-preremove-errors] [--offline] [--hardlink] [--json] [name]
+              plugins.ymlの内容をpackディレクトリに反映する
+              nameを指定した場合はそのプラグインのインストールだけを行う
+              --groupを指定した場合はgroupが一致するプラグインのインストールだけを行う
+              --hardlinkを指定した場合は、展開済みのプラグインをキャッシュに置いて
+              packごとにハードリンクで設置する（別のpack名で同じバージョンを使う場合に有効）
+              --jobs 1の場合はplugins.ymlの記述順に1件ずつインストールする
+              並行時のログはプラグインごとにまとめて、完了した順に出力する
+  list [--json] [--group name]
+              定義済みプラグインとインストール状態を一覧表示する
+  status      syncで行われる変更を表示する（差分があれば終了コード1）
+  update [--jobs N] [name]
+              branch追従のプラグインを再取得する
+  outdated    branch追従とsemver制約のプラグインのうち、更新可能なものを表示する
+  clean [--yes] [--ignore-preremove-errors]
+              plugins.ymlに存在しないディレクトリを削除する
+  cache clean ダウンロードキャッシュを削除する
+  fmt [--check]
+              plugins.ymlを整形する（--checkは整形が必要なら終了コード1、コメントは保持する）
+  restore [N] plugins.ymlをN世代前のバックアップ（デフォルトは直前の.1）に戻す
+  validate    plugins.ymlの内容をネットワークを使わずに検証する
+              （fmt --checkは書式、validateは設定内容の誤りを検出する）
+  du [--top N] [--json]
+              インストール済みプラグインのディスク使用量を表示する
+  doctor      nvim、packpath、plugins.yml、ネットワークなどの環境を診断する
+  version     バージョンとビルド情報を表示する
+
+共通オプション:
+  --config <path>
+              plugins.ymlのパスを指定する
+  --pack-name <name>
+              packディレクトリ名を指定する（環境変数TTVPACK_PACK_NAMEでも可）
+  --pack-dir <path>
+              packディレクトリのパスを指定する（環境変数TTVPACK_PACK_DIRでも可）
+              nvimを起動せずに済むので、CIやコンテナでも使える
+  --backup    add/fmtでplugins.ymlを書き換える前に.bakを残す
+  --backup-generations <N>
+              plugins.ymlを書き換える前にplugins.yml.1〜.Nのバックアップを残す（デフォルトは5、0で無効）
+  --no-color  色付きで出力しない（環境変数NO_COLORでも可）
+  --log-file <path>
+              ログファイルのパスを指定する（デフォルトは$XDG_STATE_HOME/ttvpack/ttvpack.log）
+              ログファイルには--quietなどの指定に関係なく詳細なログを記録する
+  --no-log    ログファイルに書き出さない
+  --max-rate <size>
+              ダウンロードの帯域を1秒あたりsizeまでに制限する（例: 2MB、500K）
+              並列にダウンロードする場合も、全体の合計で制限する
+  --verbose   zipエントリの展開など詳細なログを出力する
+  --quiet     エラー以外のログを出力しない`)
+}
+
+func add(ctx context.Context, pluginsFilePath string, args []string) error {
+	flags := flag.NewFlagSet("add", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "解決したtagを確認せずに追加する")
+	verify := flags.Bool("verify", false, "書き込む前にアーカイブのURLが存在するか確認する")
+	opt := flags.Bool("opt", false, "startではなくoptに追加する（:packaddで読み込む）")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return errors.New("追加するプラグインのURLを指定してください。")
+	}
+
+	var p Plugin
+	var err error
+	resolved := repoPattern.MatchString(flags.Arg(0))
+	if resolved {
+		// username/repo形式の場合は最新のreleaseタグを解決する
+		p, err = resolvePlugin(ctx, flags.Arg(0))
+	} else {
+		p, err = parsePluginUrl(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	// repoやurlのtypoをその場で検出する
+	if *verify {
+		u, err := pluginUrl(p)
+		if err != nil {
+			return err
+		}
+		if err := verifyUrl(ctx, u); err != nil {
+			return fmt.Errorf("%sを取得できません: %w", p.Repo, err)
+		}
+		logger.Debugf("verified %s", u)
+	}
+
+	if resolved && !*yes {
+		version := "tag " + p.Tag
+		if p.Tag == "" {
+			version = "branch " + p.Branch
+		}
+		if !confirm(fmt.Sprintf("%sを%sで追加します。よろしいですか？", p.Repo, version)) {
+			logger.Infof("canceled")
+			return nil
+		}
+	}
+
+	plugins, err := readPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+
+	// 既存エントリと重複する場合はスキップ
+	for _, existing := range slices.Concat(plugins.Start, plugins.Opt) {
+		if existing.Repo == p.Repo {
+			logger.Infof("already exists: %s", p.Repo)
+			return nil
+		}
+	}
+
+	// 既存のコメントを残すため、構造体ではなくASTに追加して書き戻す
+	doc, err := readPluginsDoc(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	kind := "start"
+	if *opt {
+		kind = "opt"
+	}
+	if err := doc.appendPlugin(kind, p); err != nil {
+		return err
+	}
+	if err := doc.write(pluginsFilePath); err != nil {
+		return err
+	}
+	if *opt {
+		logger.Infof("added: %s (opt)", p.Repo)
+		// optのプラグインは起動時に読み込まれないので、読み込み方を案内する
+		logger.Infof("syncした後、:packadd %s で読み込んでください", makeDirName(p))
+		return nil
+	}
+	logger.Infof("added: %s", p.Repo)
+	return nil
+}
+
+// GitHubのアーカイブURLからrepo/tag/branchを解析する
+//
+//	https://github.com/username/repo/archive/refs/tags/v1.0.0.zip
+//	https://github.com/username/repo/archive/refs/heads/main.zip
+func parsePluginUrl(rawUrl string) (Plugin, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return Plugin{}, fmt.Errorf("URLの解析に失敗しました: %w", err)
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 6 || parts[2] != "archive" || parts[3] != "refs" || !strings.HasSuffix(u.Path, ".zip") {
+		return Plugin{}, fmt.Errorf("対応していないURL形式です: %s", rawUrl)
+	}
+
+	p := Plugin{
+		Repo: parts[0] + "/" + parts[1],
+		Url:  rawUrl,
+	}
+	ref := strings.TrimSuffix(strings.Join(parts[5:], "/"), ".zip")
+	switch parts[4] {
+	case "tags":
+		p.Tag = ref
+	case "heads":
+		p.Branch = ref
+	default:
+		return Plugin{}, fmt.Errorf("対応していないURL形式です: %s", rawUrl)
+	}
+	return p, nil
+}
+
+// plugins.ymlからプラグインを削除する
+// インストール済みのディレクトリは次のsyncで削除される
+func remove(pluginsFilePath string, args []string) error {
+	if len(args) < 1 {
+		return errors.New("削除するプラグインの名前かrepoを指定してください。")
+	}
+	name := args[0]
+
+	// includeしたファイルは書き換えないので、このファイルに書かれたものだけを探す
+	plugins, err := readPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	type match struct {
+		kind  string
+		index int
+		repo  string
+	}
+	var matches []match
+	for kind, list := range map[string][]Plugin{"start": plugins.Start, "opt": plugins.Opt} {
+		for i, p := range list {
+			if p.name() == name || normalizeRepo(p.Repo) == normalizeRepo(name) {
+				matches = append(matches, match{kind, i, p.Repo})
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("%sにプラグインが見つかりません: %s", pluginsFilePath, name)
+	case 1:
+	default:
+		var candidates []string
+		for _, m := range matches {
+			candidates = append(candidates, fmt.Sprintf("%s (%s)", m.repo, m.kind))
+		}
+		slices.Sort(candidates)
+		return fmt.Errorf("%sに一致するプラグインが複数あります（repoで指定してください）:\n  %s", name, strings.Join(candidates, "\n  "))
+	}
+
+	doc, err := readPluginsDoc(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	if err := doc.removePlugin(matches[0].kind, matches[0].index); err != nil {
+		return err
+	}
+	if err := doc.write(pluginsFilePath); err != nil {
+		return err
+	}
+	logger.Infof("removed: %s (%s)", matches[0].repo, matches[0].kind)
+	logger.Infof("syncするとインストール済みのディレクトリも削除されます")
+	return nil
+}
+
+// syncコマンドのオプション
+type syncOptions struct {
+	// 実際のダウンロード・削除・解凍を行わず、操作内容だけを出力する
+	dryRun bool
+	// ロックファイルに記録されたurlとsha256で取得する
+	locked bool
+	// buildに失敗してもエラーにせず続行する
+	ignoreBuildErrors bool
+	// 失敗したプラグインがあっても残りのプラグインを全て処理する
+	keepGoing bool
+	// ゴミ掃除を行わず、インストールだけを行う
+	skipCleanup bool
+	// 削除対象が多い場合も確認せずに削除する
+	force bool
+	// preremoveに失敗してもディレクトリを削除する
+	ignorePreremoveErrors bool
+}
+
+func sync(ctx context.Context, pluginsFilePath, packPath string, args []string) error {
+	var opts syncOptions
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "実際の操作を行わず、実行される操作だけを表示する")
+	flags.BoolVar(&opts.locked, "locked", false, "plugins.lockの内容を正として取得する")
+	flags.BoolVar(&opts.ignoreBuildErrors, "ignore-build-errors", false, "buildに失敗したプラグインがあっても続行する")
+	flags.BoolVar(&opts.keepGoing, "keep-going", false, "失敗したプラグインがあっても残りを全て処理し、最後にまとめて報告する")
+	flags.BoolVar(&opts.force, "force", false, "削除対象が多い場合も確認せずに削除する")
+	flags.BoolVar(&opts.ignorePreremoveErrors, "ignore-preremove-errors", false, "preremoveに失敗してもプラグインを削除する")
+	noCache := flags.Bool("no-cache", false, "ダウンロードキャッシュを使わない")
+	noSymlinks := flags.Bool("no-symlinks", false, "アーカイブ内のシンボリックリンクを作成しない")
+	jobs := flags.Int("jobs", downloadJobs, "同時にダウンロードするプラグインの数（1で逐次実行）")
+	flags.IntVar(&extractJobs, "extract-jobs", extractJobs, "同時に展開するプラグインの数")
+	only := flags.String("only", "", "処理するグループ（startまたはopt）")
+	groupName := flags.String("group", "", "groupフィールドが一致するプラグインだけを処理する")
+	flags.BoolVar(&strictHost, "strict-host", false, "想定外のホストへのリダイレクトを拒否する")
+	flags.BoolVar(&offline, "offline", false, "ダウンロードキャッシュとfile://のurlだけでインストールする")
+	flags.BoolVar(&useHardlink, "hardlink", false, "展開済みのプラグインを共有し、ハードリンクで設置する")
+	jsonOutput := flags.Bool("json", false, "プラグインごとの処理結果をJSONで標準出力に出す（ログは標準エラー出力に出す）")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *only != "" && *only != "start" && *only != "opt" {
+		return fmt.Errorf("--onlyにはstartかoptを指定してください: %s", *only)
+	}
+
+	if err := setDownloadJobs(*jobs); err != nil {
+		return err
+	}
+	if extractJobs < 1 {
+		return fmt.Errorf("--extract-jobsには1以上を指定してください: %d", extractJobs)
+	}
+	extractSem = make(chan struct{}, extractJobs)
+
+	if *noCache {
+		useDownloadCache = false
+	}
+	// 標準出力はJSONだけにする
+	if *jsonOutput {
+		logger.useStderr()
+	}
+	if *noSymlinks {
+		allowSymlinks = false
+	}
+
+	logger.Debugf("start sync")
+
+	// dry-runはファイル操作を行わないのでロックしない
+	if !opts.dryRun {
+		unlock, err := acquireSyncLock(packPath)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	for _, p := range plugins.Start {
+		if p.requiredBy != "" {
+			logger.Infof("resolved dependency: %s (required by %s)", p.Repo, p.requiredBy)
+		}
+	}
+
+	lockPath := lockFilePath(pluginsFilePath)
+	lock, err := readLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	// --locked/--offline時はAPIを使わず、ロックファイルに記録されたタグを使う
+	if err := resolveTagConstraints(ctx, plugins, lock, !offline && !(opts.locked && lock != nil)); err != nil {
+		return err
+	}
+	// 変わっていないプラグインは、インストール済みかどうかをディレクトリの存在だけで判定する
+	if n := markUnchanged(plugins, lock); n > 0 {
+		logger.Debugf("%d plugins unchanged since last sync", n)
+	}
+
+	// optのプラグインはpackaddで手動ロードする前提なので、インストールだけ保証する
+	// 失敗したプラグインがあれば以降のプラグインは処理しない
+	// --keep-going時は全て処理してからまとめて報告する
+	// いずれの場合も、成功したプラグインはインストールされたままにする
+	var installed, verified []lockedPlugin
+	var summary syncSummary
+	groups := pluginGroups(packPath, plugins)
+	// プラグイン名が指定された場合は、そのプラグインのインストールだけを行う
+	if flags.NArg() > 0 {
+		groups, err = selectPlugin(groups, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		opts.skipCleanup = true
+	}
+	// 他のグループのプラグインを消さないよう、ゴミ掃除はしない
+	if *groupName != "" {
+		groups = filterByGroup(groups, *groupName)
+		opts.skipCleanup = true
+	}
+	// ゴミ掃除で消される前に、start/optを移動しただけのプラグインを移しておく
+	// --only指定時は対象外のグループに触らないよう移動もしない
+	if *only == "" && !opts.skipCleanup {
+		migratePlugins(groups, opts.dryRun)
+	}
+	if *only != "" {
+		groups = slices.DeleteFunc(groups, func(g pluginGroup) bool { return g.kind != *only })
+	}
+	counter := &progressCounter{total: countPending(groups)}
+	for _, group := range groups {
+		if !opts.keepGoing && len(summary.failures) > 0 {
+			break
+		}
+		// 前処理
+		if !opts.dryRun {
+			os.MkdirAll(group.dir, extractDirMode)
+		}
+		// lockファイルが無い場合は通常のsyncを行い、新規生成する
+		if opts.locked && lock != nil {
+			group.plugins = lock.apply(group.kind, group.plugins)
+		}
+
+		results, checked, err := syncGroup(ctx, group, opts, &summary, counter)
+		if err != nil {
+			return err
+		}
+		installed = append(installed, results...)
+		verified = append(verified, checked...)
+	}
+
+	if opts.dryRun {
+		return nil
+	}
+	// 他のプラグインに依存するコマンドもあるので、全てのインストールが終わってから実行する
+	for _, group := range groups {
+		for _, p := range group.plugins {
+			if !slices.ContainsFunc(installed, func(l lockedPlugin) bool { return l.Kind == group.kind && l.Repo == p.Repo }) {
+				continue
+			}
+			if p.PostinstallNvim == "" {
+				continue
+			}
+			start := time.Now()
+			err := runPostinstallNvim(ctx, group.kind, p)
+			summary.record(makeDirName(p), "postinstall", time.Since(start), err)
+			if err != nil {
+				events.emit(ctx, Event{Plugin: makeDirName(p), Kind: EventError, Repo: p.Repo, Err: err})
+				summary.fail(makeDirName(p), err)
+			}
+		}
+	}
+	// 成功したプラグインの分はロックファイルに反映する
+	if err := writeLockFile(lockPath, makeLockFile(plugins, lock, installed, verified)); err != nil {
+		return err
+	}
+	// 並行処理のログと混ざらないよう、JSONは最後にまとめて出力する
+	if *jsonOutput {
+		results := summary.results
+		if results == nil {
+			results = []syncResult{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	}
+	return summary.report()
+}
+
+// start/optのディレクトリ1つ分について、ゴミ掃除とインストールを行う
+// 今回インストールしたプラグインと、インストール済みであることを確認したプラグインの情報を返す
+// プラグインごとのエラーはsummaryに記録し、続行できないエラーのみ返す
+func syncGroup(ctx context.Context, group pluginGroup, opts syncOptions, summary *syncSummary, counter *progressCounter) (installed, verified []lockedPlugin, err error) {
+	dir := group.dir
+
+	// ゴミ掃除
+	logger.Debugf("remove not used plugins")
+	// dry-run時はディレクトリが未作成の場合があるので空とみなす
+	var unused []string
+	if !opts.skipCleanup {
+		unused, err = findUnusedPlugins(group)
+		if err != nil && !(opts.dryRun && errors.Is(err, fs.ErrNotExist)) {
+			return nil, nil, err
+		}
+	}
+	if !opts.dryRun && !opts.force && needsRemoveConfirm(group, unused) {
+		logger.Warnf("%sから%d件のプラグインを削除しようとしています", group.kind, len(unused))
+		for _, entry := range unused {
+			logger.Warnf("  %s", filepath.Base(entry))
+		}
+		// 対話的に実行されていれば確認し、そうでなければ--forceを求める
+		if !isTerminal(os.Stdin) {
+			return nil, nil, errors.New("標準入力が端末ではないため削除の確認ができません（意図した削除であれば--forceを指定してください）")
+		}
+		if !confirm("削除しますか？") {
+			return nil, nil, errors.New("削除を中止しました（意図した削除であれば--forceを指定してください）")
+		}
+	}
+	for _, entry := range unused {
+		if opts.dryRun {
+			logger.Infof("[dry-run] would remove %s", filepath.Base(entry))
+			continue
+		}
+		start := time.Now()
+		err := removePlugin(ctx, entry, opts.ignorePreremoveErrors)
+		summary.record(filepath.Base(entry), "remove", time.Since(start), err)
+		if err != nil {
+			events.emit(ctx, Event{Plugin: filepath.Base(entry), Kind: EventError, Err: err})
+			summary.fail(filepath.Base(entry), err)
+			continue
+		}
+		events.emit(ctx, Event{Plugin: filepath.Base(entry), Kind: EventRemoved})
+		summary.removed++
+	}
+
+	// インストール
+	existedPlugins, err := listDirEntries(dir)
+	if err != nil && !(opts.dryRun && errors.Is(err, fs.ErrNotExist)) {
+		return nil, nil, err
+	}
+
+	// 同時ダウンロード数を制限しつつ並行でインストールする
+	// 失敗しても実行中のプラグインはキャンセルせず、エラーは後でまとめて報告する
+	// 認証失敗などの致命的なエラーの場合だけ、実行中のものもキャンセルして全体を止める
+	// 結果はプラグインごとの位置に書き込むので排他制御は不要
+	results := make([]lockedPlugin, len(group.plugins))
+	errs := make([]error, len(group.plugins))
+	durations := make([]time.Duration, len(group.plugins))
+	var failed atomic.Bool
+	runner := newPluginRunner()
+	gctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	for i, p := range group.plugins {
+		if (!opts.keepGoing && failed.Load()) || gctx.Err() != nil {
+			break
+		}
+		if reason := skipReason(p, dir, existedPlugins); reason != skipNone {
+			if reason == skipInstalled {
+				verified = append(verified, lockedPlugin{Repo: p.Repo, Kind: group.kind})
+			}
+			events.emit(ctx, Event{Plugin: makeDirName(p), Kind: EventSkipped, Repo: p.Repo, Detail: skipDetails[reason]})
+			summary.skipped++
+			summary.record(makeDirName(p), "skip", 0, nil)
+			continue
+		}
+
+		if opts.dryRun {
+			u, err := pluginUrl(p)
+			if err != nil {
+				return nil, nil, err
+			}
+			logger.Infof("[dry-run] would download %s", u)
+			continue
+		}
+
+		runner.run(gctx, func(ctx context.Context) {
+			events.emit(ctx, Event{Plugin: makeDirName(p), Kind: EventInstallStart, Repo: p.Repo, Index: counter.next(), Total: counter.total})
+			start := time.Now()
+			locked, err := installPlugin(ctx, dir, p)
+			durations[i] = time.Since(start)
+			if err != nil {
+				events.emit(ctx, Event{Plugin: makeDirName(p), Kind: EventError, Repo: p.Repo, Err: err})
+				errs[i] = err
+				failed.Store(true)
+				if isFatal(err) {
+					cancel(err)
+				}
+				return
+			}
+			locked.Kind = group.kind
+			results[i] = locked
+		})
+	}
+	runner.wait()
+	if gctx.Err() != nil && ctx.Err() == nil {
+		return nil, nil, fmt.Errorf("致命的なエラーのため中断しました: %w", context.Cause(gctx))
+	}
+
+	// ビルドは重いことが多いので、インストール完了後に逐次実行する
+	for i, p := range group.plugins {
+		if errs[i] != nil {
+			summary.record(makeDirName(p), "install", durations[i], errs[i])
+			summary.fail(makeDirName(p), errs[i])
+			continue
+		}
+		if results[i].Repo == "" {
+			continue
+		}
+		summary.record(makeDirName(p), "install", durations[i], nil)
+		summary.installed++
+		if p.Build == "" {
+			continue
+		}
+		start := time.Now()
+		err := runBuild(ctx, filepath.Join(dir, makeDirName(p)), p)
+		summary.record(makeDirName(p), "build", time.Since(start), err)
+		if err != nil {
+			events.emit(ctx, Event{Plugin: makeDirName(p), Kind: EventError, Repo: p.Repo, Err: err})
+			if !opts.ignoreBuildErrors {
+				summary.fail(makeDirName(p), err)
+				continue
+			}
+			logger.Errorf("%v", err)
+		}
+	}
+
+	return slices.DeleteFunc(results, func(l lockedPlugin) bool { return l.Repo == "" }), verified, nil
+}
+
+// インストールをスキップする理由
+const (
+	skipNone = iota
+	skipInstalled
+	skipPinned
+	skipOffline
+)
+
+// EventSkippedのDetailに入れる理由
+var skipDetails = map[int]string{
+	skipInstalled: skipDetailInstalled,
+	skipPinned:    skipDetailPinned,
+	skipOffline:   skipDetailOffline,
+}
+
+// プラグインをインストールする必要があるかどうかを判定し、不要ならその理由を返す
+func skipReason(p Plugin, dir string, existedPlugins []string) int {
+	// listDirEntriesはフルパスを返すので、フルパス同士で比較する
+	// メタ情報のバージョンが異なる場合は入れ直す
+	expandedPath := filepath.Join(dir, makeDirName(p))
+	if slices.Contains(existedPlugins, expandedPath) {
+		if p.unchanged {
+			return skipInstalled
+		}
+		if meta, ok := readPluginMeta(expandedPath); !ok || !meta.differs(p) {
+			return skipInstalled
+		}
+	}
+	if pinnedInstalled(p, existedPlugins) {
+		return skipPinned
+	}
+	if offline && !availableOffline(p) {
+		return skipOffline
+	}
+	return skipNone
+}
+
+// 全グループでインストールが必要なプラグインの数を数える
+func countPending(groups []pluginGroup) int {
+	n := 0
+	for _, group := range groups {
+		existedPlugins, _ := listDirEntries(group.dir)
+		for _, p := range group.plugins {
+			if skipReason(p, group.dir, existedPlugins) == skipNone {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// 確認なしで削除するプラグインの上限
+const maxRemoveWithoutConfirm = 5
+
+// ディレクトリ名の付け方の変更やplugins.ymlを誤って空にした場合などの大量削除を防ぐため、
+// 削除対象が多い場合と全プラグインが消える場合は確認を求める
+func needsRemoveConfirm(group pluginGroup, unused []string) bool {
+	if len(unused) > maxRemoveWithoutConfirm {
+		return true
+	}
+	return len(unused) > 0 && len(group.plugins) == 0
+}
+
+// repoのベース名がnameと一致するプラグインだけを残したグループを返す
+// 一致するプラグインが無い、または複数ある場合はエラーにする
+func selectPlugin(groups []pluginGroup, name string) ([]pluginGroup, error) {
+	var selected []pluginGroup
+	var candidates []string
+	for _, group := range groups {
+		var matched []Plugin
+		for _, p := range group.plugins {
+			if p.name() == name {
+				matched = append(matched, p)
+				candidates = append(candidates, fmt.Sprintf("%s (%s)", p.Repo, group.kind))
+			}
+		}
+		group.plugins = matched
+		selected = append(selected, group)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("プラグインが見つかりません: %s", name)
+	case 1:
+		return selected, nil
+	default:
+		return nil, fmt.Errorf("%sに一致するプラグインが複数あります:\n  %s", name, strings.Join(candidates, "\n  "))
+	}
+}
+
+// start/optのディレクトリのうち、plugins.ymlに存在しないもののパスを返す
+func findUnusedPlugins(group pluginGroup) ([]string, error) {
+	pluginsMap := makePluginsMap(group.plugins)
+
+	// ディレクトリの1階層のみをwalkし、リストを作る
+	existedPlugins, err := listDirEntries(group.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ディレクトリリストをループし、pluginsの中に存在しないものを集める
+	// pinされたプラグインのディレクトリは対象外
+	var unused []string
+	for _, entry := range existedPlugins {
+		if _, ok := pluginsMap[filepath.Base(entry)]; ok {
+			continue
+		}
+		if _, ok := pinnedOwner(group.plugins, entry); ok {
+			continue
+		}
+		unused = append(unused, entry)
+	}
+	return unused, nil
+}
+
+// プラグインをダウンロードしてdir配下に展開する
+// ロックファイルに記録するための取得結果を返す
+func installPlugin(ctx context.Context, dir string, p Plugin) (lockedPlugin, error) {
+	dirName := makeDirName(p)
+	u, err := pluginUrl(p)
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+
+	ctxLogger(ctx).Debugf("url %s", u)
+
+	// 開発中のプラグインなど、ローカルのディレクトリを直接指している場合
+	if src, ok := localPath(u); ok {
+		if info, err := os.Stat(src); err == nil && info.IsDir() {
+			return installLocalDir(ctx, dir, p, u, src)
+		}
+	}
+
+	// 並行ダウンロードでも衝突しないようプラグインごとにユニークな名前にする
+	tmp, err := os.CreateTemp(dir, dirName+"-*"+archiveExt(u))
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+	zipPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(zipPath)
+
+	sum, fromCache, err := fetchZip(ctx, dirName, p, u, zipPath)
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+	// sha256が指定されていれば検証する（zipはdeferで削除される）
+	if p.Sha256 != "" && !strings.EqualFold(sum, p.Sha256) {
+		if cachePath, ok := pluginCachePath(p, u); ok && fromCache {
+			os.Remove(cachePath)
+		}
+		return lockedPlugin{}, fmt.Errorf("%s: sha256が一致しません (expected %s, got %s)", p.Repo, p.Sha256, sum)
+	}
+	if !fromCache {
+		storeCache(p, u, zipPath)
+	}
+
+	expandedPath := filepath.Join(dir, dirName)
+	commit := cmp.Or(zipCommit(zipPath), p.Commit)
+	if unchangedInstall(expandedPath, u, sum, p) {
+		events.emit(ctx, Event{Plugin: dirName, Kind: EventSkipped, Repo: p.Repo, Detail: skipDetailUnchanged})
+		return lockedPlugin{
+			Repo:   p.Repo,
+			Tag:    p.Tag,
+			Branch: p.Branch,
+			Commit: commit,
+			Url:    u,
+			Sha256: sum,
+		}, nil
+	}
+
+	ctxLogger(ctx).Debugf("zip %s", zipPath)
+	// 途中で失敗しても中途半端なプラグインが残らないよう、
+	// 一時ディレクトリに展開してから最終パスへ移動する
+	tmpDir, err := os.MkdirTemp(dir, "."+dirName+"-*")
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+	// MkdirTempは0700で作られるので、通常のディレクトリと同じ権限にする
+	if err := os.Chmod(tmpDir, extractDirMode); err != nil {
+		return lockedPlugin{}, err
+	}
+	events.emit(ctx, Event{Plugin: dirName, Kind: EventExtractStart, Repo: p.Repo})
+	// buildやパッチはプラグインのディレクトリ内のファイルを書き換えることがあるので、ストアを共有しない
+	if useHardlink && p.Build == "" && len(p.Patches) == 0 {
+		if err := extractViaStore(ctx, u, zipPath, sum, tmpDir); err != nil {
+			return lockedPlugin{}, fmt.Errorf("%sのアーカイブを展開できませんでした (%s): %w", p.Repo, u, err)
+		}
+		events.emit(ctx, Event{Plugin: dirName, Kind: EventExtractDone, Repo: p.Repo})
+	} else {
+		stats, err := extractArchiveLimited(ctx, u, zipPath, tmpDir)
+		if err != nil {
+			return lockedPlugin{}, fmt.Errorf("%sのアーカイブを展開できませんでした (%s): %w", p.Repo, u, err)
+		}
+		events.emit(ctx, Event{Plugin: dirName, Kind: EventExtractDone, Repo: p.Repo, Files: stats.files, Bytes: stats.bytes})
+	}
+
+	// rtpが指定されていれば、そのサブディレクトリをプラグインのルートとして扱う
+	rootDir, err := pluginRoot(tmpDir, p)
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+	if err := applyPatches(ctx, rootDir, p); err != nil {
+		return lockedPlugin{}, err
+	}
+	verifyCheckFile(ctx, rootDir, p)
+
+	meta := pluginMeta{
+		Repo:        p.Repo,
+		Tag:         p.Tag,
+		Branch:      p.Branch,
+		Commit:      commit,
+		Url:         u,
+		Sha256:      sum,
+		Rtp:         p.Rtp,
+		Preremove:   p.Preremove,
+		InstalledAt: time.Now(),
+	}
+	if err := writePluginMeta(rootDir, meta); err != nil {
+		return lockedPlugin{}, err
+	}
+
+	// update時の再取得に備えて、既存のディレクトリは置き換える
+	stats, err := replacePluginDir(rootDir, expandedPath)
+	if err != nil {
+		return lockedPlugin{}, err
+	}
+	if stats != (replaceStats{}) {
+		ctxLogger(ctx).Debugf("updated %d files, removed %d, unchanged %d (%s)", stats.updated, stats.removed, stats.unchanged, dirName)
+	}
+	events.emit(ctx, Event{Plugin: dirName, Kind: EventInstalled, Repo: p.Repo})
+	return lockedPlugin{
+		Repo:   p.Repo,
+		Tag:    p.Tag,
+		Branch: p.Branch,
+		Commit: commit,
+		Url:    u,
+		Sha256: sum,
+	}, nil
+}
+
+// プラグインごとにダウンロード→展開をパイプラインで進めつつ、
+// 展開だけはextractJobsの数まで同時に行う
+func extractArchiveLimited(ctx context.Context, u, src, dest string) (extractStats, error) {
+	select {
+	case extractSem <- struct{}{}:
+	case <-ctx.Done():
+		return extractStats{}, ctx.Err()
+	}
+	defer func() { <-extractSem }()
+
+	return extractArchive(ctx, u, src, dest)
+}
+
+// 展開したディレクトリのうち、プラグインのルートとなるディレクトリを返す
+func pluginRoot(expandedDir string, p Plugin) (string, error) {
+	if p.Rtp == "" {
+		return expandedDir, nil
+	}
+
+	root := filepath.Join(expandedDir, filepath.FromSlash(p.Rtp))
+	if !strings.HasPrefix(root, filepath.Clean(expandedDir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("%s: 不正なrtpです: %s", p.Repo, p.Rtp)
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s: rtpのディレクトリがアーカイブ内にありません: %s", p.Repo, p.Rtp)
+	}
+	return root, nil
+}
+
+func listDirEntries(dirPath string) ([]string, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		fullPath := filepath.Join(dirPath, entry.Name())
+		paths = append(paths, fullPath)
+	}
+	return paths, nil
+}
+
+func readPlugins(path string) (*Plugins, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// 未知のキー（tagをtagsと書いた場合など）はエラーにする
+	var plugins Plugins
+	if err := yaml.UnmarshalWithOptions(data, &plugins, yaml.DisallowUnknownField()); err != nil {
+		return nil, fmt.Errorf("%s:\n%s", path, yaml.FormatError(err, false, true))
+	}
+
+	if err := validatePlugins(data, &plugins); err != nil {
+		return nil, fmt.Errorf("%s:\n%w", path, err)
+	}
+
+	return &plugins, nil
+}
+
+// 2スペースインデントの正規形でYAMLにする
+// cmにはCommentToMapで読み取ったコメントを渡し、同じパスの要素に付け直す
+func marshalPlugins(plugins *Plugins, cm yaml.CommentMap) ([]byte, error) {
+	return yaml.MarshalWithOptions(plugins, yaml.Indent(2), yaml.IndentSequence(true), yaml.WithComment(cm))
+}
+
+// start/optの種別ごとのインストール先とプラグイン
+type pluginGroup struct {
+	kind    string
+	dir     string
+	plugins []Plugin
+}
+
+func pluginGroups(packPath string, plugins *Plugins) []pluginGroup {
+	return []pluginGroup{
+		{kind: "start", dir: filepath.Join(packPath, "start"), plugins: enabledPlugins(plugins.Start)},
+		{kind: "opt", dir: filepath.Join(packPath, "opt"), plugins: enabledPlugins(plugins.Opt)},
+	}
+}
+
+func makePluginsMap(plugins []Plugin) map[string]string {
+	pluginsMap := make(map[string]string)
+	for _, p := range plugins {
+		key := makeDirName(p)
+		pluginsMap[key] = p.Tag
+	}
+	return pluginsMap
+}
+
+// nvimの実行ファイルのパスを返す
+// NVIM_BINが設定されていればそれを使い、無ければPATHから探す
+func nvimPath() (string, error) {
+	bin := os.Getenv("NVIM_BIN")
+	if bin == "" {
+		bin = "nvim"
+	}
+	p, err := exec.LookPath(bin)
+	if err != nil {
+		return "", fmt.Errorf("nvimが見つかりません（NVIM_BINで実行ファイルのパスを指定できます）: %w", err)
+	}
+	return p, nil
+}
+
+// デフォルトのpackディレクトリ名
+const defaultPackName = "ttpack"
+
+// --pack-name、環境変数TTVPACK_PACK_NAME、デフォルトの順にpack名を決める
+func resolvePackName(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv("TTVPACK_PACK_NAME"); env != "" {
+		return env
+	}
+	return defaultPackName
+}
+
+// --pack-dir、環境変数TTVPACK_PACK_DIRで指定されていればそれを使い、nvimの起動を省く
+// 指定が無ければnvimのpackpathから求め、nvimを起動できない場合は標準のパスから推測する
+func resolvePackDir(flagValue, packName string) (string, error) {
+	if dir := cmp.Or(flagValue, os.Getenv("TTVPACK_PACK_DIR")); dir != "" {
+		return filepath.Abs(dir)
+	}
+	dir, err := getPackDir(packName)
+	if err == nil {
+		return dir, nil
+	}
+	fallback, ferr := defaultPackDir(packName)
+	if ferr != nil {
+		return "", err
+	}
+	logger.Warnf("nvimからpackpathを取得できないため、%sを使います: %v", fallback, err)
+	return fallback, nil
+}
+
+// nvimのstdpath("data")/siteにあたるディレクトリをpackpathとみなす
+func defaultPackDir(packName string) (string, error) {
+	var dataDir string
+	if xdgDataHome := os.Getenv("XDG_DATA_HOME"); xdgDataHome != "" {
+		dataDir = filepath.Join(xdgDataHome, "nvim")
+	} else if runtime.GOOS == "windows" {
+		localAppData := os.Getenv("LOCALAPPDATA")
+		if localAppData == "" {
+			return "", errors.New("LOCALAPPDATAが設定されていません。")
+		}
+		dataDir = filepath.Join(localAppData, "nvim-data")
+	} else {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataDir = filepath.Join(home, ".local", "share", "nvim")
+	}
+	return filepath.Join(dataDir, "site", "pack", packName), nil
+}
+
+func getPackDir(packName string) (string, error) {
+	nvim, err := nvimPath()
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(nvim, "--headless", "-c", "lua io.stdout:write(vim.o.packpath)", "-c", "qa")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	// packpathはカンマ区切りで複数ディレクトリを含むので、先頭のエントリを使う
+	var packDir string
+	for _, p := range strings.Split(strings.TrimSpace(string(output)), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			packDir = p
+			break
+		}
+	}
+	if packDir == "" {
+		return "", errors.New("packpathが取得できませんでした。")
+	}
+
+	dir := filepath.Join(packDir, "pack", packName)
+	return dir, nil
+}
+
+func getPluginsFilePath() string {
+
+	fileName := "plugins.yml"
+
+	// XDG_CONFIG_HOMEの取得
+	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	if xdgConfigHome != "" {
+		return filepath.Join(xdgConfigHome, "nvim", fileName)
+	}
+
+	switch runtime.GOOS {
+	case "windows":
+		localAppData := os.Getenv("LOCALAPPDATA")
+		if localAppData != "" {
+			return filepath.Join(localAppData, "nvim", fileName)
+		} else {
+			return fileName
+		}
+	default:
+		// Goは~を展開しないので、ホームディレクトリを明示的に取得する
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fileName
+		}
+		return filepath.Join(home, ".config", "nvim", fileName)
+	}
+
 }
 
-func main() {
-	if err := run(); err != nil {
-		fmt.Fprintf(os.Stderr, "エラー: %v\n", err)
-		os.Exit(1)
+// tag/branchを含めたディレクトリ名を作る
+// バージョンを切り替えるとディレクトリ名が変わるので、古いものはゴミ掃除で削除される
+func makeDirName(plugin Plugin) string {
+	dir := plugin.name()
+
+	if plugin.Commit != "" {
+		dir = dir + "-" + shortCommit(plugin.Commit)
+	} else if plugin.Tag != "" {
+		dir = dir + "-" + plugin.Tag
+	} else if plugin.Branch != "" {
+		dir = dir + "-" + plugin.Branch
 	}
+	return sanitizeDirName(dir)
 }
 
-func run() error {
+// ディレクトリ名の衝突を検出する
+// 同じディレクトリにインストールされるものはエラーにし、バージョンやstart/optが違うだけで名前が同じものは警告にする
+func checkNameConflicts(plugins *Plugins) error {
+	type entry struct {
+		kind   string
+		plugin Plugin
+	}
+	var entries []entry
+	for _, p := range enabledPlugins(plugins.Start) {
+		entries = append(entries, entry{"start", p})
+	}
+	for _, p := range enabledPlugins(plugins.Opt) {
+		entries = append(entries, entry{"opt", p})
+	}
 
-	// plugins.ymlの取得
-	pluginsFilePath := getPluginsFilePath()
-	fmt.Println(pluginsFilePath)
+	var errs []error
+	for i, a := range entries {
+		for _, b := range entries[i+1:] {
+			switch {
+			case a.kind == b.kind && makeDirName(a.plugin) == makeDirName(b.plugin):
+				errs = append(errs, fmt.Errorf("%s: %s (%s) と %s (%s) のディレクトリ名が重複しています（nameで別の名前を指定してください）",
+					makeDirName(a.plugin), a.plugin.Repo, a.kind, b.plugin.Repo, b.kind))
+			case a.plugin.name() == b.plugin.name():
+				logger.Warnf("%s: %s (%s) と %s (%s) の名前が同じです（nameで別の名前を指定してください）",
+					a.plugin.name(), a.plugin.Repo, a.kind, b.plugin.Repo, b.kind)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	// packフォルダパスの取得
-	err, packPath := getPackDir()
-	if err != nil {
-		return err
+// commit hashの先頭7文字を返す
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
 	}
-	fmt.Println(packPath)
+	return commit
+}
 
-	if len(os.Args) < 1 {
-		return errors.New("コマンドを指定してください。")
+// ディレクトリ名に使えない文字を置き換える
+var dirNameReplacer = strings.NewReplacer(
+	"/", "-", "\\", "-", ":", "-", "*", "-", "?", "-",
+	"\"", "-", "<", "-", ">", "-", "|", "-",
+)
+
+// 検証を通らなかった場合にも、packディレクトリ自身や親ディレクトリを指す名前は返さない
+func sanitizeDirName(name string) string {
+	name = dirNameReplacer.Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
 	}
-	cmd := os.Args[1]
-	switch cmd {
-	case "add":
-		add()
-	case "rm":
-		remove()
-	case "sync":
-		return sync(pluginsFilePath, packPath)
+	return name
+}
+
+// repoとcommit/tag/branchからアーカイブURLを組み立てる
+// 複数指定されている場合の優先順位は commit > tag > branch
+// hostが未指定の場合はgithub.comとみなす
+func makeUrl(plugin Plugin) (string, error) {
+	repo := strings.Trim(plugin.Repo, "/")
+	if repo == "" {
+		return "", errors.New("repoが指定されていません")
+	}
+
+	host := plugin.Host
+	if host == "" {
+		host = "github.com"
+	}
+
+	switch host {
+	case "github.com":
+		// tagとbranchはref名ではなくフィールドで区別する
+		// branchはmain/master以外でもrefs/heads/、tagはvの有無に関わらずそのままrefs/tags/に使う
+		baseUrl := "https://github.com/"
+		switch {
+		case plugin.Commit != "":
+			return url.JoinPath(baseUrl, repo, "archive/", plugin.Commit+".zip")
+		case plugin.Tag != "":
+			return url.JoinPath(baseUrl, repo, "archive/refs/tags/", plugin.Tag+".zip")
+		case plugin.Branch == defaultBranchRef:
+			// refs/heads/HEADというブランチは無いので、デフォルトブランチはref名を付けずに取得する
+			return url.JoinPath(baseUrl, repo, "archive/", defaultBranchRef+".zip")
+		case plugin.Branch != "":
+			return url.JoinPath(baseUrl, repo, "archive/refs/heads/", plugin.Branch+".zip")
+		}
+	case "gitlab.com":
+		// https://gitlab.com/<repo>/-/archive/<ref>/<name>-<ref>.zip
+		baseUrl := "https://gitlab.com/"
+		ref := cmp.Or(plugin.Commit, plugin.Tag, plugin.Branch)
+		if ref != "" {
+			fileName := path.Base(repo) + "-" + strings.ReplaceAll(ref, "/", "-") + ".zip"
+			return url.JoinPath(baseUrl, repo, "-/archive", ref, fileName)
+		}
+	case "codeberg.org":
+		// Gitea系: https://codeberg.org/<repo>/archive/<ref>.zip
+		baseUrl := "https://codeberg.org/"
+		ref := cmp.Or(plugin.Commit, plugin.Tag, plugin.Branch)
+		if ref != "" {
+			return url.JoinPath(baseUrl, repo, "archive", ref+".zip")
+		}
+	case "git.sr.ht":
+		// sourcehutはtar.gzのみ: https://git.sr.ht/~<user>/<repo>/archive/<ref>.tar.gz
+		baseUrl := "https://git.sr.ht/"
+		if !strings.HasPrefix(repo, "~") {
+			repo = "~" + repo
+		}
+		ref := cmp.Or(plugin.Commit, plugin.Tag, plugin.Branch)
+		if ref != "" {
+			return url.JoinPath(baseUrl, repo, "archive", ref+".tar.gz")
+		}
+	case "bitbucket.org":
+		// https://bitbucket.org/<repo>/get/<ref>.zip
+		// トップレベルディレクトリは<user>-<repo>-<commit>になる
+		baseUrl := "https://bitbucket.org/"
+		ref := cmp.Or(plugin.Commit, plugin.Tag, plugin.Branch)
+		if ref != "" {
+			return url.JoinPath(baseUrl, repo, "get", ref+".zip")
+		}
 	default:
-		return errors.New("存在しないコマンドです。")
+		return "", fmt.Errorf("%s: 対応していないホストです（手動でurlを指定してください）: %s", plugin.Repo, host)
 	}
+	return "", fmt.Errorf("%s: commit/tag/branchのいずれかを指定してください", plugin.Repo)
+}
 
-	return nil
+// plugins.ymlのurlが省略されていればmakeUrlで補完する
+func pluginUrl(plugin Plugin) (string, error) {
+	if plugin.Url != "" {
+		return plugin.Url, nil
+	}
+	return makeUrl(plugin)
 }
 
-func add() error {
-	fmt.Println("add")
-	return nil
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXYを尊重するよう、Transportで明示的にプロキシを設定する
+var httpTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
 }
 
-func remove() error {
-	fmt.Println("remove")
-	return nil
+// APIや存在確認など、レスポンスが小さいリクエスト用
+var httpClient = &http.Client{
+	Timeout:       60 * time.Second,
+	CheckRedirect: checkRedirect,
+	Transport:     httpTransport,
 }
 
-func sync(pluginsFilePath, packPath string) error {
-	fmt.Println("start sync")
+// アーカイブのダウンロード用
+// --max-rateで帯域を絞ると全体の時間は読めないので、全体のタイムアウトは設けず、
+// レスポンスヘッダの待ち時間（ResponseHeaderTimeout）とデータが届かない時間（downloadIdleTimeout）だけを制限する
+var downloadClient = &http.Client{
+	CheckRedirect: checkRedirect,
+	Transport:     httpTransport,
+}
 
-	startPath := filepath.Join(packPath, "start")
-	optPath := filepath.Join(packPath, "opt")
+// ダウンロード中にデータが届かないまま待つ時間の上限
+var downloadIdleTimeout = 60 * time.Second
 
-	plugins, err := readPlugins(pluginsFilePath)
-	if err != nil {
-		return err
+// trueの場合、想定外のホストへのリダイレクトを拒否する
+var strictHost = false
+
+// リダイレクトの最大回数（http.Clientのデフォルトと同じ）
+const maxRedirects = 10
+
+// --strict-host時は、リダイレクト先が元のホストと同じか、
+// GitHubのアーカイブの配信元であることを確認する
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("リダイレクトが多すぎます: %s", via[0].URL)
 	}
-	startPluginsMap := makePluginsMap(plugins.Start)
-	// optPluginsMap := makePluginsMap(plugins.Opt)
+	if !strictHost {
+		return nil
+	}
+	origin := via[0].URL.Hostname()
+	if slices.Contains(allowedRedirectHosts(origin), req.URL.Hostname()) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s -> %s", errUnexpectedRedirect, via[0].URL, req.URL)
+}
 
-	// 前処理
-	os.MkdirAll(startPath, 0755)
-	os.MkdirAll(optPath, 0755)
+var errUnexpectedRedirect = errors.New("想定外のホストへのリダイレクトを拒否しました")
 
-	// ゴミ掃除
-	fmt.Println("remove not used plugins")
-	// startフォルダのディレクトリの1階層のみをwalkし、リストを作る
-	existedStartPlugins, err := listDirEntries(startPath)
-	if err != nil {
-		return err
+func allowedRedirectHosts(origin string) []string {
+	switch origin {
+	case "github.com", "codeload.github.com":
+		return []string{"github.com", "codeload.github.com"}
+	default:
+		return []string{origin}
 	}
+}
 
-	// ディレクトリリストをループし、pluginsの中に存在しない場合は、ディレクトリを削除する
-	for _, entry := range existedStartPlugins {
-		if _, ok := startPluginsMap[filepath.Base(entry)]; ok {
-			// exist
-		} else {
-			// not exist
-			if err := os.RemoveAll(entry); err != nil {
-				return err
-			}
-			fmt.Println("removed: ", filepath.Base(entry))
+// 同時ダウンロード数
+// ネットワークI/Oが主なので4程度とし、CPU数が少なければそちらに合わせる
+var downloadJobs = min(4, runtime.NumCPU())
+
+// プラグインごとの処理をdownloadJobsの数まで並行に実行する
+// 1の場合はgoroutineを使わずplugins.ymlの順にその場で実行するので、ログも記述順に決定的に出る
+// 並行時はプラグインごとのログをバッファし、そのプラグインの処理が終わった時点でまとめて出力する
+type pluginRunner struct {
+	g        errgroup.Group
+	parallel bool
+}
+
+func newPluginRunner() *pluginRunner {
+	r := &pluginRunner{parallel: downloadJobs > 1}
+	r.g.SetLimit(downloadJobs)
+	return r
+}
+
+func (r *pluginRunner) run(ctx context.Context, fn func(ctx context.Context)) {
+	if !r.parallel {
+		if ctx.Err() == nil {
+			fn(ctx)
 		}
+		return
 	}
+	r.g.Go(func() error {
+		// 空きを待っている間に致命的なエラーで中断された場合
+		if ctx.Err() != nil {
+			return nil
+		}
+		l := logger.buffered()
+		defer l.flush()
+		fn(withLogger(ctx, l))
+		return nil
+	})
+}
 
-	// optフォルダのディレクトリの1階層のみをwalkし、リストを作る
-	// ディレクトリリストをループし、pluginsの中に存在しない場合は、ディレクトリを削除する
+func (r *pluginRunner) wait() {
+	r.g.Wait()
+}
 
-	// インストール
-	// startのpluginsをループ
-	existedStartPlugins, err = listDirEntries(startPath)
-	if err != nil {
-		return err
+// --jobsの値を検証してdownloadJobsに反映する
+func setDownloadJobs(n int) error {
+	if n < 1 {
+		return fmt.Errorf("--jobsには1以上を指定してください: %d", n)
 	}
+	downloadJobs = n
+	return nil
+}
 
-	for _, p := range plugins.Start {
-		dirName := makeDirName(p)
-		if slices.Contains(existedStartPlugins, dirName) {
-			continue
-		}
+// 同時展開数
+// ディスクIOがボトルネックになりやすいので、ダウンロードとは別に制限する
+var extractJobs = 2
 
+// 展開の同時実行数を制限するセマフォ
+var extractSem = make(chan struct{}, extractJobs)
 
-		zipPath := filepath.Join(startPath, dirName+".zip")
-		if err := downloadZip(p.Url, zipPath); err != nil {
-			return err
+// ダウンロード失敗時の最大リトライ回数
+var downloadRetries = 3
+
+// HTTPステータスが200以外だったことを表すエラー
+type httpStatusError struct {
+	url        string
+	statusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("ダウンロードに失敗しました: %s (status %d)", e.url, e.statusCode)
+}
+
+// urlsを順に試し、最初に取得できたものをdestに保存して内容のSHA-256を返す
+// sha256が指定されていれば、一致しないものは失敗として次のurlを試す
+// headersは認証情報を含むことが多いので、先頭のurlと同じホストにだけ送る
+func downloadWithFallback(ctx context.Context, name string, p Plugin, urls []string, dest string) (string, error) {
+	var errs []error
+	for i, u := range urls {
+		var headers map[string]string
+		if sameHost(u, urls[0]) {
+			headers = p.Headers
 		}
+		sum, err := downloadZip(ctx, name, u, dest, headers)
+		if err == nil && p.Sha256 != "" && !strings.EqualFold(sum, p.Sha256) {
+			err = fmt.Errorf("sha256が一致しません: %s (expected %s, got %s)", u, p.Sha256, sum)
+		}
+		if err == nil {
+			if i > 0 {
+				ctxLogger(ctx).Infof("downloaded %s from mirror %s", name, u)
+				if p.Sha256 == "" {
+					ctxLogger(ctx).Warnf("%s: sha256が指定されていないため、ミラーから取得した内容を検証していません", p.Repo)
+				}
+			} else {
+				ctxLogger(ctx).Debugf("downloaded %s from %s", name, u)
+			}
+			return sum, nil
+		}
+		errs = append(errs, err)
+		// 中断や認証の失敗はミラーを試しても解決しない
+		if ctx.Err() != nil || isFatal(err) {
+			break
+		}
+		if i+1 < len(urls) {
+			ctxLogger(ctx).Warnf("%s: %v（次のURLを試します）", name, err)
+		}
+	}
+	return "", errors.Join(errs...)
+}
 
-		fmt.Println("zip ", zipPath)
-		expandedPath := filepath.Join(startPath, dirName)
-		// unzip(zipPath, expandedPath)
-		// unzip(zipPath, ".")
-		if err := unzipWithoutTopLevel(zipPath, expandedPath); err != nil {
-			return err
+func sameHost(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	return errA == nil && errB == nil && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// urlからzipをダウンロードしてdestに保存し、内容のSHA-256を返す
+func downloadZip(ctx context.Context, name, url, dest string, headers map[string]string) (string, error) {
+	if _, ok := localPath(url); ok {
+		return copyLocalArchive(url, dest)
+	}
+	if offline {
+		return "", fmt.Errorf("%w: %s", errOffline, url)
+	}
+
+	partPath, unlock := lockPartial(url, dest)
+	defer unlock()
+
+	backoff := time.Second
+	for i := 0; ; i++ {
+		sum, err := downloadZipOnce(ctx, name, url, dest, partPath, headers)
+		if err == nil || i >= downloadRetries || !isRetryable(ctx, err) {
+			// destの隣に置いた.partは次回のsyncで再開できないので残さない
+			if err != nil && partPath == dest+".part" {
+				removePartial(partPath)
+			}
+			return sum, err
 		}
-		if err := os.Remove(zipPath); err != nil {
-			return err
+
+		ctxLogger(ctx).Infof("retry %d/%d: %s", i+1, downloadRetries, url)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
 		}
-		fmt.Println("installed ", dirName)
+		backoff *= 2
 	}
+}
 
-	// startフォルダのリストに存在しなければ、ダウンロードする
-	// ダウンロードできたら、非同期でzip解凍を行う
-	// optのpluginsをループし
-	// optフォルダのリストに存在しなければ、ダウンロードする
-	// ダウンロードできたら、非同期でzip解凍を行う
+// ネットワークエラーと5xx、壊れたアーカイブのみリトライ対象とする
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= 500
+	}
+	var brokenErr *brokenArchiveError
+	if errors.As(err, &brokenErr) {
+		return true
+	}
+	// リダイレクトの拒否もurl.Errorとして返るが、やり直しても結果は変わらない
+	if errors.Is(err, errUnexpectedRedirect) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
 
-	return nil
+// GITHUB_TOKENが設定されていれば、GitHub宛てのリクエストに認証ヘッダを付ける
+// 他のホストにトークンを送らないようホスト名を確認する
+func setGitHubToken(req *http.Request) bool {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return false
+	}
+	switch req.URL.Hostname() {
+	case "github.com", "codeload.github.com", "api.github.com":
+		req.Header.Set("Authorization", "Bearer "+token)
+		return true
+	}
+	return false
 }
 
-func listDirEntries(dirPath string) ([]string, error) {
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
-		return nil, err
+// plugins.ymlのheadersをリクエストに付ける
+// 値は認証情報のことが多いので、ログにはマスクして出す
+func setPluginHeaders(req *http.Request, headers map[string]string) {
+	for _, key := range slices.Sorted(maps.Keys(headers)) {
+		req.Header.Set(key, headers[key])
+		ctxLogger(req.Context()).Debugf("header %s: %s", key, maskSecret(headers[key]))
 	}
+}
 
-	var paths []string
-	for _, entry := range entries {
-		fullPath := filepath.Join(dirPath, entry.Name())
-		paths = append(paths, fullPath)
+// 先頭の数文字だけを残して伏せる
+// 短い値は推測できてしまうので全て伏せる
+func maskSecret(s string) string {
+	if len(s) < 12 {
+		return "****"
 	}
-	return paths, nil
+	return s[:4] + "****"
 }
 
-func readPlugins(path string) (*Plugins, error) {
-	data, err := os.ReadFile(path)
+// 途中で切れた場合に続きから取得できるよう、partPathに書き込んでから正式名にする
+func downloadZipOnce(ctx context.Context, name, url, dest, partPath string, headers map[string]string) (string, error) {
+	var offset int64
+	var validator string
+	if info, err := os.Stat(partPath); err == nil {
+		// ETagかLast-Modifiedが無いと、サーバー側で内容が変わっていても検出できない
+		// branchのアーカイブは日々変わるので、別の版と継ぎ接ぎにならないよう最初から取り直す
+		if v, err := os.ReadFile(partPath + ".validator"); err == nil && len(v) > 0 {
+			offset = info.Size()
+			validator = string(v)
+		} else {
+			removePartial(partPath)
+		}
+	}
+
+	// データが届かなくなったらリクエストをキャンセルする
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// サーバー側のファイルが変わっていれば、206ではなく200で全体が返る
+		req.Header.Set("If-Range", validator)
 	}
+	authorized := setGitHubToken(req)
+	// plugins.ymlのheadersはGITHUB_TOKENより優先する
+	setPluginHeaders(req, headers)
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-	var plugins Plugins
-	if err := yaml.Unmarshal(data, &plugins); err != nil {
-		return nil, err
+	if resp.StatusCode == http.StatusUnauthorized && authorized {
+		return "", &fatalError{fmt.Errorf("GITHUB_TOKENが無効または権限不足です: %s (status %d)", url, resp.StatusCode)}
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == offset:
+	case resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// 書きかけのファイルと範囲が合わないので、最初から取り直す
+		removePartial(partPath)
+		resp.Body.Close()
+		return downloadZipOnce(ctx, name, url, dest, partPath, headers)
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			ctxLogger(ctx).Debugf("range not supported, restart %s", name)
+		}
+		offset = 0
+	default:
+		return "", &httpStatusError{url: url, statusCode: resp.StatusCode}
 	}
+	ctxLogger(ctx).Debugf("download from %s", resp.Request.URL)
+	events.emit(ctx, Event{Plugin: name, Kind: EventDownloadStart, Bytes: offset})
 
-	return &plugins, nil
+	out, hash, err := openPartial(partPath, offset)
+	if err != nil {
+		return "", err
+	}
+	if offset == 0 {
+		writeValidator(partPath, resp)
+	}
+
+	// ダウンロードしながらハッシュを計算する
+	// 中断やエラー時は.partを残し、次回は続きから取得する
+	total := resp.ContentLength
+	if total > 0 {
+		total += offset
+	}
+	progress := newProgressWriter(ctx, name, total)
+	progress.written = offset
+	body := newIdleTimeoutReader(resp.Body, downloadIdleTimeout, cancel)
+	defer body.stop()
+	if _, err := io.Copy(io.MultiWriter(out, hash), io.TeeReader(limitRate(ctx, body), progress)); err != nil {
+		out.Close()
+		var idleErr *idleTimeoutError
+		if cause := context.Cause(ctx); errors.As(cause, &idleErr) {
+			return "", cause
+		}
+		return "", err
+	}
+	progress.finish()
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	// 0バイトや切り詰められたアーカイブはここで検出して削除する
+	if err := checkArchive(url, partPath); err != nil {
+		removePartial(partPath)
+		return "", err
+	}
+	if err := movePartial(partPath, dest); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func makePluginsMap(plugins []Plugin) map[string]string {
-	pluginsMap := make(map[string]string)
-	for _, p := range plugins {
-		key := makeDirName(p)
-		pluginsMap[key] = p.Tag
+// 一定時間データが届かなかったことを表すエラー
+// 通信が切れたのと同じく、リトライ対象のネットワークエラーとして扱う
+type idleTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *idleTimeoutError) Error() string {
+	return fmt.Sprintf("%vの間データを受信できませんでした", e.timeout)
+}
+
+func (e *idleTimeoutError) Timeout() bool   { return true }
+func (e *idleTimeoutError) Temporary() bool { return true }
+
+// 読み込むたびにタイマーを延長し、timeoutの間データが届かなければcancelを呼ぶ
+type idleTimeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutReader(r io.Reader, timeout time.Duration, cancel context.CancelCauseFunc) *idleTimeoutReader {
+	return &idleTimeoutReader{
+		r:       r,
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			cancel(&idleTimeoutError{timeout: timeout})
+		}),
 	}
-	return pluginsMap
 }
 
-func getPackDir() (error, string) {
-	cmd := exec.Command("nvim", "--headless", "-c", "lua io.stdout:write(vim.o.packpath)", "-c", "qa")
-	output, err := cmd.Output()
-	if err != nil {
-		return err, ""
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
 	}
-	dir := filepath.Join(string(output), "pack", "ttpack")
-	return nil, dir
+	return n, err
 }
 
-func getPluginsFilePath() string {
+func (r *idleTimeoutReader) stop() {
+	r.timer.Stop()
+}
 
-	fileName := "plugins.yml"
+// Content-Range: bytes <start>-<end>/<size> の開始位置を返す
+// 取得できない場合は-1を返す
+func contentRangeStart(resp *http.Response) int64 {
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d", &start, &end); err != nil {
+		return -1
+	}
+	return start
+}
 
-	// XDG_CONFIG_HOMEの取得
-	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
-	if xdgConfigHome != "" {
-		return filepath.Join(xdgConfigHome, "nvim", fileName)
+// 書きかけのファイルを開き、既存部分のハッシュを計算しておく
+// offsetが0の場合は最初から書き直す
+func openPartial(partPath string, offset int64) (*os.File, hash.Hash, error) {
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	if offset == 0 {
+		out, err := os.Create(partPath)
+		return out, h, err
 	}
 
-	switch runtime.GOOS {
-	case "windows":
-		localAppData := os.Getenv("LOCALAPPDATA")
-		if localAppData != "" {
-			return filepath.Join(localAppData, "nvim", fileName)
-		} else {
-			return fileName
+	out, err := os.OpenFile(partPath, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.CopyN(h, out, offset); err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return out, h, nil
+}
+
+// 再開時にサーバー側のファイルが変わっていないか確認するため、ETagかLast-Modifiedを保存する
+func writeValidator(partPath string, resp *http.Response) {
+	// 弱いETagはIf-Rangeに使えない
+	etag := resp.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		etag = ""
+	}
+	validator := cmp.Or(etag, resp.Header.Get("Last-Modified"))
+	if validator == "" {
+		os.Remove(partPath + ".validator")
+		return
+	}
+	os.WriteFile(partPath+".validator", []byte(validator), 0644)
+}
+
+func removePartial(partPath string) {
+	os.Remove(partPath)
+	os.Remove(partPath + ".validator")
+}
+
+// 取得が完了した.partを正式名にする
+// キャッシュディレクトリとpackディレクトリが別のファイルシステムの場合はコピーする
+func movePartial(partPath, dest string) error {
+	if err := os.Rename(partPath, dest); err != nil {
+		if err := copyFile(partPath, dest, 0644); err != nil {
+			return err
 		}
-	default:
-		return filepath.Join("~", ".config", "nvim", fileName)
 	}
+	removePartial(partPath)
+	return nil
+}
 
+// ダウンロードしたアーカイブが壊れていることを表すエラー
+// 再取得で直る可能性があるのでリトライ対象にする
+type brokenArchiveError struct {
+	url    string
+	reason string
 }
 
-func makeDirName(plugin Plugin) string {
-	dir := path.Base(plugin.Repo)
-
-	// if plugin.Tag != "" {
-	// 	dir = dir + "-" + plugin.Tag
-	// } else if plugin.Branch != "" {
-	// 	dir = dir + "-" + plugin.Branch
-	// }
-	return dir
-}
-
-// func makeUrl(plugin Plugin) (string, error) {
-// 	targetUrl := ""
-// 	var err error
-// 	baseUrl := "https://github.com/"
-// 	if plugin.Tag == "master" || plugin.Tag == "main" {
-// 		targetUrl, err = url.JoinPath(baseUrl, plugin.Repo, "archive/refs/heads/", plugin.Tag+".zip")
-// 		if err != nil {
-// 			return targetUrl, err
-// 		}
-// 	} else {
-// 		targetUrl, err = url.JoinPath(baseUrl, plugin.Repo, "archive/refs/tags/", plugin.Tag+".zip")
-// 		return targetUrl, err
-// 	}
-// 	return targetUrl, err
-// }
-
-func downloadZip(url, dest string) error {
-	resp, err := http.Get(url)
+func (e *brokenArchiveError) Error() string {
+	return fmt.Sprintf("壊れたアーカイブです: %s (%s)", e.url, e.reason)
+}
+
+// ダウンロードしたファイルがアーカイブとして開けるか確認する
+func checkArchive(url, path string) error {
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	if info.Size() == 0 {
+		return &brokenArchiveError{url: url, reason: "0バイト"}
+	}
 
-	out, err := os.Create(dest)
+	if isTarArchive(url, path) {
+		return nil
+	}
+	r, err := zip.OpenReader(path)
 	if err != nil {
-		return err
+		return &brokenArchiveError{url: url, reason: err.Error()}
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
+	return r.Close()
 }
 
 func unzip(src, dest string) error {
@@ -305,19 +1984,19 @@ func unzip(src, dest string) error {
 
 		if f.FileInfo().IsDir() {
 			// ディレクトリの作成
-			if err := os.MkdirAll(fpath, os.ModePerm); err != nil {
+			if err := os.MkdirAll(fpath, extractDirMode); err != nil {
 				return fmt.Errorf("ディレクトリの作成に失敗しました: %w", err)
 			}
 			continue
 		}
 
 		// 親ディレクトリの作成
-		if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		if err := os.MkdirAll(filepath.Dir(fpath), extractDirMode); err != nil {
 			return fmt.Errorf("親ディレクトリの作成に失敗しました: %w", err)
 		}
 
 		// 出力ファイルの作成
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, extractFileMode(f.Mode()))
 		if err != nil {
 			return fmt.Errorf("出力ファイルの作成に失敗しました: %w", err)
 		}
@@ -339,73 +2018,138 @@ func unzip(src, dest string) error {
 	return nil
 }
 
+// 全エントリに共通するトップレベルディレクトリ名を返す
+// ルート直下にファイルが混在するなど、共通prefixが無い場合は空文字を返す
+func commonTopLevelDir(names []string) string {
+	prefix := ""
+	for _, name := range names {
+		dir, _, found := strings.Cut(name, "/")
+		if !found || dir == "" {
+			return ""
+		}
+		if prefix == "" {
+			prefix = dir
+		} else if prefix != dir {
+			return ""
+		}
+	}
+	return prefix
+}
+
+func unzipWithoutTopLevel(ctx context.Context, src, dest string) (extractStats, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return extractStats{}, fmt.Errorf("zip ファイルのオープンに失敗しました: %w", err)
+	}
+	defer r.Close()
+
+	return extractWithoutTopLevel(ctx, zipArchive{r}, dest)
+}
+
+// 展開したファイルの統計
+// 巨大なアーカイブを掴んだときに気づけるよう、verboseログに出す
+type extractStats struct {
+	files int
+	bytes int64
+}
+
+// アーカイブを展開する
+// 全エントリに共通するトップレベルディレクトリがあれば剥がしてdestに展開する
+func extractWithoutTopLevel(ctx context.Context, a archive, dest string) (extractStats, error) {
+	var stats extractStats
+	// トップレベルディレクトリ名を特定
+	names, err := a.names()
+	if err != nil {
+		return stats, fmt.Errorf("アーカイブのエントリ一覧の取得に失敗しました: %w", err)
+	}
+	topLevelDir := commonTopLevelDir(names)
+
+	err = a.walk(func(entry archiveEntry) error {
+		// どのエントリのどの段階で失敗したか分かるようにする
+		fail := func(stage string, err error) error {
+			return fmt.Errorf("%s の展開に失敗しました（%s）: %w", entry.name, stage, err)
+		}
+
+		// トップレベルディレクトリを除外
+		relPath := entry.name
+		if topLevelDir != "" {
+			if strings.HasPrefix(entry.name, topLevelDir+"/") {
+				relPath = strings.TrimPrefix(entry.name, topLevelDir+"/")
+			} else {
+				// 一致しない場合はそのまま
+				relPath = entry.name
+			}
+		}
+
+		// Zip スリップ攻撃を防ぐためのパス検証
+		fpath := filepath.Join(dest, relPath)
+		if fpath != filepath.Clean(dest) && !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("不正なファイルパス: %s", fpath)
+		}
+		if err := checkRealPath(dest, fpath); err != nil {
+			return err
+		}
+
+		if entry.mode.IsDir() {
+			if err := os.MkdirAll(fpath, extractDirMode); err != nil {
+				return fail("ディレクトリの作成", err)
+			}
+			return nil
+		}
+
+		if entry.mode&os.ModeSymlink != 0 {
+			if !allowSymlinks {
+				ctxLogger(ctx).Warnf("シンボリックリンクを無視しました: %s", relPath)
+				return nil
+			}
+			ctxLogger(ctx).Debugf("  symlink %s -> %s", relPath, entry.linkname)
+			if err := extractSymlink(dest, fpath, entry.linkname); err != nil {
+				return fail("シンボリックリンクの作成", err)
+			}
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fpath), extractDirMode); err != nil {
+			return fail("親ディレクトリの作成", err)
+		}
+
+		// 同名のシンボリックリンクがある場合、リンク先に書き込まないよう置き換える
+		if info, err := os.Lstat(fpath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(fpath)
+		}
+
+		ctxLogger(ctx).Debugf("  extract %s", relPath)
+		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, extractFileMode(entry.mode))
+		if err != nil {
+			return fail("出力ファイルの作成", err)
+		}
 
-func unzipWithoutTopLevel(src, dest string) error {
-    r, err := zip.OpenReader(src)
-    if err != nil {
-        return err
-    }
-    defer r.Close()
-
-    // トップレベルディレクトリ名を特定
-    topLevelDir := ""
-    for _, f := range r.File {
-        parts := strings.Split(f.Name, "/")
-        if len(parts) > 1 {
-            if topLevelDir == "" {
-                topLevelDir = parts[0]
-            } else if topLevelDir != parts[0] {
-                topLevelDir = ""
-                break
-            }
-        } else {
-            topLevelDir = ""
-            break
-        }
-    }
-
-    for _, f := range r.File {
-        // トップレベルディレクトリを除外
-        relPath := f.Name
-        if topLevelDir != "" {
-            if strings.HasPrefix(f.Name, topLevelDir+"/") {
-                relPath = strings.TrimPrefix(f.Name, topLevelDir+"/")
-            } else {
-                // 一致しない場合はそのまま
-                relPath = f.Name
-            }
-        }
-
-        fpath := filepath.Join(dest, relPath)
-
-        if f.FileInfo().IsDir() {
-            os.MkdirAll(fpath, os.ModePerm)
-            continue
-        }
-
-        if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-            return err
-        }
-
-        outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-        if err != nil {
-            return err
-        }
-
-        rc, err := f.Open()
-        if err != nil {
-            outFile.Close()
-            return err
-        }
-
-        _, err = io.Copy(outFile, rc)
-
-        outFile.Close()
-        rc.Close()
-
-        if err != nil {
-            return err
-        }
-    }
-    return nil
+		rc, err := entry.open()
+		if err != nil {
+			outFile.Close()
+			return fail("アーカイブ内のファイルのオープン", err)
+		}
+
+		n, err := io.Copy(outFile, rc)
+		rc.Close()
+		if err != nil {
+			outFile.Close()
+			return fail("ファイルのコピー", err)
+		}
+		if err := outFile.Close(); err != nil {
+			return fail("ファイルの書き込み", err)
+		}
+		stats.files++
+		stats.bytes += n
+
+		// OpenFileに渡したmodeはumaskで実行ビットが落ちることがあるので、明示的に設定し直す
+		// Windowsにはモードの概念が無いのでスキップする
+		if runtime.GOOS != "windows" {
+			if err := os.Chmod(fpath, extractFileMode(entry.mode)); err != nil {
+				return fail("パーミッションの設定", err)
+			}
+		}
+		return nil
+	})
+	return stats, err
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ダウンロードの途中ファイルをテスト用の一時ディレクトリに置く
+func setupDownloadTest(t *testing.T) string {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	return t.TempDir()
+}
+
+func TestDownloadZipOnceIdleTimeout(t *testing.T) {
+	dir := setupDownloadTest(t)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("PK"))
+		w.(http.Flusher).Flush()
+		// 残りを送らずに止まる
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	old := downloadIdleTimeout
+	downloadIdleTimeout = 200 * time.Millisecond
+	defer func() { downloadIdleTimeout = old }()
+
+	ctx := context.Background()
+	u := srv.URL + "/foo.zip"
+	dest := filepath.Join(dir, "foo.zip")
+	_, err := downloadZipOnce(ctx, "foo", u, dest, partialPath(u, dest), nil)
+	var idleErr *idleTimeoutError
+	if !errors.As(err, &idleErr) {
+		t.Fatalf("err = %v, want idleTimeoutError", err)
+	}
+	if !isRetryable(ctx, err) {
+		t.Error("データが届かなくなった場合はリトライ対象にする")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.zip")); err == nil {
+		t.Error("途中までのファイルが正式名で残っています")
+	}
+}
+
+func TestMakeUrl(t *testing.T) {
+	tests := []struct {
+		name   string
+		plugin Plugin
+		want   string
+	}{
+		{"tag", Plugin{Repo: "u/r", Tag: "v1.0.0"}, "https://github.com/u/r/archive/refs/tags/v1.0.0.zip"},
+		{"branch", Plugin{Repo: "u/r", Branch: "main"}, "https://github.com/u/r/archive/refs/heads/main.zip"},
+		{"main/master以外のbranch", Plugin{Repo: "u/r", Branch: "develop"}, "https://github.com/u/r/archive/refs/heads/develop.zip"},
+		{"vの付かないtag", Plugin{Repo: "u/r", Tag: "1.2.3"}, "https://github.com/u/r/archive/refs/tags/1.2.3.zip"},
+		{"tagとbranchの両方があればtagを優先", Plugin{Repo: "u/r", Tag: "v1.0.0", Branch: "main"}, "https://github.com/u/r/archive/refs/tags/v1.0.0.zip"},
+		{"commitはtagより優先", Plugin{Repo: "u/r", Commit: "0123456", Tag: "v1.0.0"}, "https://github.com/u/r/archive/0123456.zip"},
+		{"前後のスラッシュ", Plugin{Repo: "/u/r/", Tag: "v1.0.0"}, "https://github.com/u/r/archive/refs/tags/v1.0.0.zip"},
+		{"連続したスラッシュ", Plugin{Repo: "u//r", Branch: "main"}, "https://github.com/u/r/archive/refs/heads/main.zip"},
+		{"エンコードが必要なtag", Plugin{Repo: "u/r", Tag: "v1.0.0+build 1"}, "https://github.com/u/r/archive/refs/tags/v1.0.0+build%201.zip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := makeUrl(tt.plugin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("makeUrl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeUrlWithoutRepo(t *testing.T) {
+	for _, repo := range []string{"", "/", "//"} {
+		if _, err := makeUrl(Plugin{Repo: repo, Tag: "v1.0.0"}); err == nil {
+			t.Errorf("makeUrl(%q) はエラーになるべき", repo)
+		}
+	}
+}
+
+func TestDownloadZipNotFound(t *testing.T) {
+	dir := setupDownloadTest(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>Not Found</html>", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	u := srv.URL + "/u/r/archive/refs/tags/v9.9.9.zip"
+	dest := filepath.Join(dir, "r.zip")
+	_, err := downloadZip(context.Background(), "r-v9.9.9", u, dest, nil)
+
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) || statusErr.statusCode != http.StatusNotFound {
+		t.Fatalf("err = %v, want status 404", err)
+	}
+	if !strings.Contains(err.Error(), u) {
+		t.Errorf("エラーメッセージに失敗したURLが含まれていません: %v", err)
+	}
+	for _, path := range []string{dest, partialPath(u, dest), dest + ".part"} {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("ファイルが残っています: %s", path)
+		}
+	}
+}
+
+func TestDownloadZipOnceResume(t *testing.T) {
+	data, err := os.ReadFile(writeTestZip(t, t.TempDir(), []zipTestEntry{
+		{name: "top/README", body: strings.Repeat("readme\n", 100)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		validator string
+		// 書きかけの.partの内容
+		partial   []byte
+		wantRange bool
+	}{
+		{"ETagがあれば続きから取得する", `"v1"`, data[:100], true},
+		// 別の版の先頭が書きかけになっている場合に、継ぎ接ぎにしない
+		{"ETagが無ければ最初から取得する", "", []byte("stale snapshot of another version"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupDownloadTest(t)
+			var gotRange, gotIfRange string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotRange = r.Header.Get("Range")
+				gotIfRange = r.Header.Get("If-Range")
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "foo.zip", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			u := srv.URL + "/foo.zip"
+			dest := filepath.Join(dir, "foo.zip")
+			partPath := partialPath(u, dest)
+			if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(partPath, tt.partial, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.validator != "" {
+				if err := os.WriteFile(partPath+".validator", []byte(tt.validator), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := downloadZipOnce(context.Background(), "foo", u, dest, partPath, nil); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantRange {
+				if gotRange == "" || gotIfRange != tt.validator {
+					t.Errorf("Range = %q, If-Range = %q, want If-Range %q", gotRange, gotIfRange, tt.validator)
+				}
+			} else if gotRange != "" {
+				t.Errorf("検証用の値が無いのにRangeで再開しました: %q", gotRange)
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("ダウンロードした内容が一致しません")
+			}
+		})
+	}
+}
+
+func TestDownloadZipWhilePartialLocked(t *testing.T) {
+	dir := setupDownloadTest(t)
+	data, err := os.ReadFile(writeTestZip(t, t.TempDir(), []zipTestEntry{
+		{name: "top/README", body: strings.Repeat("readme\n", 100)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "foo.zip", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	u := srv.URL + "/foo.zip"
+	// 別のpackディレクトリのsyncが同じurlの.partを使っている
+	shared, unlock := lockPartial(u, filepath.Join(dir, "other", "foo.zip"))
+	defer unlock()
+	if shared != partialPath(u, "") {
+		t.Fatalf("lockPartial = %s, want %s", shared, partialPath(u, ""))
+	}
+	if err := os.WriteFile(shared, []byte("in progress"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "foo.zip")
+	if got, unlock := lockPartial(u, dest); got != dest+".part" {
+		unlock()
+		t.Fatalf("ロック中の.partを使おうとしました: %s", got)
+	}
+	if _, err := downloadZip(context.Background(), "foo", u, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dest); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ダウンロードした内容が一致しません: %v", err)
+	}
+	if got, err := os.ReadFile(shared); err != nil || string(got) != "in progress" {
+		t.Errorf("他のsyncが使っている.partが変更されました: %q, %v", got, err)
+	}
+}
+
+// contentを書いたplugins.ymlを一時ディレクトリに作り、そのパスを返す
+func writeTestPluginsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugins.yml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// インストールしたプラグインのディレクトリに置くメタ情報のファイル名
+const pluginMetaFile = ".ttvpack.json"
+
+// インストール時のプラグインの情報
+// ディレクトリ名に依らず、実際に入っているバージョンを知るために使う
+type pluginMeta struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Url    string `json:"url"`
+	// ダウンロードしたアーカイブのSHA-256（ローカルのディレクトリの場合は空）
+	Sha256      string    `json:"sha256,omitempty"`
+	Rtp         string    `json:"rtp,omitempty"`
+	Preremove   string    `json:"preremove,omitempty"`
+	InstalledAt time.Time `json:"installed_at"`
+	// インストールしたttvpackのバージョン
+	InstalledBy string `json:"installed_by,omitempty"`
+}
+
+func writePluginMeta(dir string, meta pluginMeta) error {
+	meta.InstalledBy = userAgent()
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, pluginMetaFile), append(data, '\n'), 0644)
+}
+
+// メタ情報が無い（古いバージョンでインストールした）場合はfalseを返す
+func readPluginMeta(dir string) (pluginMeta, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, pluginMetaFile))
+	if err != nil {
+		return pluginMeta{}, false
+	}
+	var meta pluginMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return pluginMeta{}, false
+	}
+	return meta, true
+}
+
+// 表示用のバージョン（tag、branch@commit、commitのいずれか）
+func (m pluginMeta) version() string {
+	switch {
+	case m.Tag != "":
+		return m.Tag
+	case m.Branch != "" && m.Commit != "":
+		return m.Branch + "@" + shortCommit(m.Commit)
+	case m.Branch != "":
+		return m.Branch
+	default:
+		return shortCommit(m.Commit)
+	}
+}
+
+// plugins.ymlの指定とインストール済みのバージョンが異なるかどうか
+func (m pluginMeta) differs(p Plugin) bool {
+	if m.Repo != p.Repo || m.Tag != p.Tag || m.Branch != p.Branch {
+		return true
+	}
+	return p.Commit != "" && !strings.HasPrefix(m.Commit, p.Commit)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// start/optの間で種別だけが変わったプラグインを、ダウンロードせずにディレクトリごと移動する
+// ディレクトリ名（tag含む）が一致し、移動元の種別ではもう使われていないものが対象
+// 移動に失敗した場合は通常通り移動先で再ダウンロードされる
+func migratePlugins(groups []pluginGroup, dryRun bool) {
+	for _, to := range groups {
+		for _, p := range to.plugins {
+			dirName := makeDirName(p)
+			dest := filepath.Join(to.dir, dirName)
+			if _, err := os.Stat(dest); err == nil {
+				continue
+			}
+
+			for _, from := range groups {
+				if from.dir == to.dir {
+					continue
+				}
+				if _, ok := makePluginsMap(from.plugins)[dirName]; ok {
+					continue
+				}
+				src := filepath.Join(from.dir, dirName)
+				if info, err := os.Stat(src); err != nil || !info.IsDir() {
+					continue
+				}
+
+				if dryRun {
+					logger.Infof("[dry-run] would move %s: %s -> %s", dirName, from.kind, to.kind)
+					break
+				}
+				if err := os.MkdirAll(to.dir, extractDirMode); err != nil {
+					logger.Warnf("failed to move %s: %v", dirName, err)
+					break
+				}
+				if err := os.Rename(src, dest); err != nil {
+					logger.Warnf("failed to move %s: %v", dirName, err)
+					break
+				}
+				logger.Infof("moved %s: %s -> %s", dirName, from.kind, to.kind)
+				break
+			}
+		}
+	}
+}
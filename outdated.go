@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// GitHub APIのレスポンスをキャッシュする期間
+// outdatedを続けて実行してもレート制限に掛からないようにする
+const apiCacheTTL = 10 * time.Minute
+
+// outdatedコマンドの1行分
+type outdatedEntry struct {
+	repo    string
+	kind    string
+	current string
+	latest  string
+	// 更新に使うコマンド
+	command string
+}
+
+// branch追従とsemver制約のプラグインについて、インストール済みと最新を比較して一覧表示する
+// 実際の更新は行わない
+func outdated(ctx context.Context, pluginsFilePath, packPath string) error {
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	if err := resolveLockedTags(pluginsFilePath, plugins); err != nil {
+		return err
+	}
+
+	var entries []outdatedEntry
+	for _, group := range pluginGroups(packPath, plugins) {
+		for _, p := range group.plugins {
+			// pinされたものとGitHub以外はAPIで確認できないので対象外
+			if p.pinned() || (p.Host != "" && p.Host != "github.com") {
+				continue
+			}
+			entry, ok, err := checkOutdated(ctx, group, p)
+			if err != nil {
+				logger.Warnf("%s: 最新のバージョンを取得できませんでした: %v", p.Repo, err)
+				continue
+			}
+			if ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		logger.Infof("all plugins are up to date")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tCURRENT\tLATEST\tKIND\tCOMMAND")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.repo, e.current, e.latest, e.kind, e.command)
+	}
+	return w.Flush()
+}
+
+// 更新可能であればその情報を返す
+func checkOutdated(ctx context.Context, group pluginGroup, p Plugin) (outdatedEntry, bool, error) {
+	entry := outdatedEntry{repo: p.Repo, kind: group.kind, current: "-"}
+
+	switch {
+	case p.tagConstraint != "" || isTagConstraint(p.Tag):
+		constraint := cmp.Or(p.tagConstraint, p.Tag)
+		tags, err := fetchTags(ctx, p.Repo, true)
+		if err != nil {
+			return entry, false, err
+		}
+		latest, err := selectTag(constraint, tags)
+		if err != nil {
+			return entry, false, err
+		}
+		if p.tagConstraint != "" {
+			entry.current = p.Tag
+		}
+		entry.latest = latest
+		entry.command = "ttvpack sync"
+		return entry, entry.current != latest, nil
+
+	case p.Branch != "" && p.Tag == "" && p.Commit == "":
+		var commit struct {
+			Sha string `json:"sha"`
+		}
+		if err := getGitHubApiCached(ctx, "repos/"+p.Repo+"/commits/"+p.Branch, &commit); err != nil {
+			return entry, false, err
+		}
+		meta, ok := readPluginMeta(filepath.Join(group.dir, makeDirName(p)))
+		if ok && meta.Commit != "" {
+			entry.current = p.Branch + "@" + shortCommit(meta.Commit)
+		}
+		entry.latest = p.Branch + "@" + shortCommit(commit.Sha)
+		entry.command = "ttvpack update " + p.name()
+		updatable := !ok || meta.Commit == "" || !strings.HasPrefix(commit.Sha, meta.Commit)
+		return entry, updatable, nil
+	}
+	return entry, false, nil
+}
+
+// キャッシュが新しければそれを使い、無ければAPIを呼んでキャッシュに保存する
+func getGitHubApiCached(ctx context.Context, endpoint string, v any) error {
+	dir, err := cacheDir()
+	if err != nil {
+		return getGitHubApi(ctx, endpoint, v)
+	}
+	cachePath := filepath.Join(dir, "api", sanitizeDirName(endpoint)+".json")
+	if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < apiCacheTTL {
+		if data, err := os.ReadFile(cachePath); err == nil && json.Unmarshal(data, v) == nil {
+			logger.Debugf("api cache hit %s", endpoint)
+			return nil
+		}
+	}
+
+	if err := getGitHubApi(ctx, endpoint, v); err != nil {
+		return err
+	}
+	// キャッシュへの保存に失敗しても結果は返す
+	if data, err := json.Marshal(v); err == nil {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+			os.WriteFile(cachePath, data, 0644)
+		}
+	}
+	return nil
+}
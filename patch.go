@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// patchesの相対パスを、そのエントリを書いたplugins.ymlのディレクトリからの相対として解決する
+func resolvePatchPaths(plugins *Plugins) {
+	for _, list := range [][]Plugin{plugins.Start, plugins.Opt} {
+		for i := range list {
+			for j, patch := range list[i].Patches {
+				if !filepath.IsAbs(patch) {
+					list[i].Patches[j] = filepath.Join(list[i].sourceDir, patch)
+				}
+			}
+		}
+	}
+}
+
+// 展開したプラグインにpatchesを順に適用する
+// 1つでも失敗したらそのプラグインのインストールはエラーにする
+func applyPatches(ctx context.Context, dir string, p Plugin) error {
+	for _, patch := range p.Patches {
+		ctxLogger(ctx).Infof("patch %s: %s", p.name(), filepath.Base(patch))
+		if err := applyPatch(ctx, dir, p.name(), patch); err != nil {
+			return fmt.Errorf("%s: パッチの適用に失敗しました: %s: %w", p.Repo, patch, err)
+		}
+	}
+	return nil
+}
+
+// git applyで適用し、gitが無ければpatchコマンドを使う
+func applyPatch(ctx context.Context, dir, name, patch string) error {
+	if _, err := os.Stat(patch); err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	if git, err := exec.LookPath("git"); err == nil {
+		cmd = exec.CommandContext(ctx, git, "apply", "--whitespace=nowarn", patch)
+		// packディレクトリがdotfilesなどのリポジトリ内にあっても、そのリポジトリを基準にパスを解決しないようにする
+		cmd.Env = append(os.Environ(), "GIT_CEILING_DIRECTORIES="+filepath.Dir(dir))
+	} else if patchCmd, err := exec.LookPath("patch"); err == nil {
+		cmd = exec.CommandContext(ctx, patchCmd, "-p1", "--forward", "--batch", "-i", patch)
+	} else {
+		return errors.New("gitまたはpatchコマンドが見つかりません")
+	}
+	cmd.Dir = dir
+	return runCommand(ctx, cmd, name)
+}
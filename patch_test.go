@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPatchPathRelativeToIncludedFile(t *testing.T) {
+	path := writeTestPluginsFile(t, `
+include:
+  - sub/plugins.yml
+start:
+  - repo: u/main
+    tag: v1.0.0
+    patches:
+      - patches/main.patch
+`)
+	dir := filepath.Dir(path)
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "plugins.yml"), []byte(`
+start:
+  - repo: u/sub
+    tag: v1.0.0
+    patches:
+      - patches/sub.patch
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plugins, err := loadPlugins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"u/main": {filepath.Join(dir, "patches", "main.patch")},
+		"u/sub":  {filepath.Join(sub, "patches", "sub.patch")},
+	}
+	for _, p := range plugins.Start {
+		if !slices.Equal(p.Patches, want[p.Repo]) {
+			t.Errorf("%s: patches = %v, want %v", p.Repo, p.Patches, want[p.Repo])
+		}
+	}
+}
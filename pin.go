@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// インストール済みのディレクトリがプラグインのものかどうかを判定する
+// tag/branchを変えてもpin中は既存のディレクトリを使い続けるため、バージョン部分は見ずにメタ情報のrepoで判定する
+// 名前が前方一致するだけの別のプラグイン（nvim-treesitterに対するnvim-treesitter-textobjectsなど）は含めない
+func ownsDir(p Plugin, dir string) bool {
+	name := filepath.Base(dir)
+	base := sanitizeDirName(p.name())
+	if name != base && !strings.HasPrefix(name, base+"-") {
+		return false
+	}
+	if meta, ok := readPluginMeta(dir); ok {
+		return meta.Repo == p.Repo
+	}
+	// メタ情報が無い場合は、今の定義で作られるディレクトリ名と一致するものだけを認める
+	return name == makeDirName(p)
+}
+
+// pinされたプラグインのディレクトリならそのプラグインを返す
+func pinnedOwner(plugins []Plugin, dir string) (Plugin, bool) {
+	for _, p := range plugins {
+		if p.pinned() && ownsDir(p, dir) {
+			return p, true
+		}
+	}
+	return Plugin{}, false
+}
+
+// pinされたプラグインがインストール済みかどうか
+// インストール済みならsyncやupdateで上書きしない
+func pinnedInstalled(p Plugin, existedPlugins []string) bool {
+	if !p.pinned() {
+		return false
+	}
+	for _, entry := range existedPlugins {
+		if ownsDir(p, entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dirにrepoのメタ情報を持つプラグインのディレクトリを作る
+func writeTestPluginDir(t *testing.T, dir, name, repo string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if repo == "" {
+		return path
+	}
+	data, err := json.Marshal(pluginMeta{Repo: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, pluginMetaFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOwnsDir(t *testing.T) {
+	dir := t.TempDir()
+	treesitter := Plugin{Repo: "nvim-treesitter/nvim-treesitter", Tag: "v0.10.0"}
+
+	tests := []struct {
+		name    string
+		dirName string
+		repo    string
+		want    bool
+	}{
+		{"前のバージョン", "nvim-treesitter-v0.9.0", "nvim-treesitter/nvim-treesitter", true},
+		{"名前が前方一致する別のプラグイン", "nvim-treesitter-textobjects-main", "nvim-treesitter/nvim-treesitter-textobjects", false},
+		{"同じ名前の別のrepo", "nvim-treesitter-v0.9.0", "someone/nvim-treesitter", false},
+		{"メタ情報が無く名前が一致する", "nvim-treesitter-v0.10.0", "", true},
+		{"メタ情報が無く名前が一致しない", "nvim-treesitter-context-master", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestPluginDir(t, filepath.Join(dir, tt.name), tt.dirName, tt.repo)
+			if got := ownsDir(treesitter, path); got != tt.want {
+				t.Errorf("ownsDir(%s) = %v, want %v", tt.dirName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinnedInstalledIgnoresOtherPlugins(t *testing.T) {
+	dir := t.TempDir()
+	other := writeTestPluginDir(t, dir, "nvim-treesitter-textobjects-main", "nvim-treesitter/nvim-treesitter-textobjects")
+	p := Plugin{Repo: "nvim-treesitter/nvim-treesitter", Tag: "v0.10.0", Pin: true}
+
+	if pinnedInstalled(p, []string{other}) {
+		t.Error("インストールされていないpinのプラグインがインストール済みと判定されました")
+	}
+}
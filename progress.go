@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	// syncコマンドを実装する関数syncと名前が衝突するので別名で読み込む
+	gosync "sync"
+	"sync/atomic"
+	"time"
+)
+
+// ダウンロードの進捗をイベントとして発行するio.Writer
+// io.TeeReaderと組み合わせて使う
+type progressWriter struct {
+	ctx     context.Context
+	name    string
+	total   int64
+	written int64
+	last    time.Time
+}
+
+func newProgressWriter(ctx context.Context, name string, total int64) *progressWriter {
+	return &progressWriter{ctx: ctx, name: name, total: total}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	// 購読側の負荷にならないよう間引いて発行する
+	if time.Since(w.last) < 200*time.Millisecond {
+		return len(p), nil
+	}
+	w.last = time.Now()
+	events.emit(w.ctx, Event{Plugin: w.name, Kind: EventDownloadProgress, Bytes: w.written, TotalBytes: w.total})
+	return len(p), nil
+}
+
+// 進捗表示を完了させる
+func (w *progressWriter) finish() {
+	events.emit(w.ctx, Event{Plugin: w.name, Kind: EventDownloadDone, Bytes: w.written, TotalBytes: w.total})
+}
+
+// 進捗表示の行の上書きが他のgoroutineの出力と混ざらないようにするロック
+var progressLock gosync.Mutex
+
+// CLI向けにイベントをログとして表示する
+// 並行インストール中はプラグインごとのLoggerにためて、完了時にまとめて出力する
+// 複数のgoroutineから同時に呼ばれるので、Loggerを通さずに書く進捗表示はprogressLockで守る
+func printEvent(ctx context.Context, e Event) {
+	l := ctxLogger(ctx)
+	switch e.Kind {
+	case EventInstallStart:
+		l.Infof("[%d/%d] installing %s", e.Index, e.Total, e.Plugin)
+	case EventUpdateStart:
+		l.Infof("[%d/%d] updating %s", e.Index, e.Total, e.Plugin)
+	case EventDownloadStart:
+		if e.Bytes > 0 {
+			l.Debugf("resume %s from %s", e.Plugin, formatBytes(e.Bytes))
+		}
+	case EventDownloadProgress:
+		// 非TTYでは行の上書きができないので完了時のみ出力する
+		if l.level >= levelNormal && l.isTTY() {
+			progressLock.Lock()
+			fmt.Fprintf(l.outFile, "\r\033[K%s", downloadStatus(e))
+			progressLock.Unlock()
+		}
+	case EventDownloadDone:
+		if l.level < levelNormal {
+			return
+		}
+		if l.isTTY() {
+			progressLock.Lock()
+			fmt.Fprintf(l.outFile, "\r\033[K%s\n", downloadStatus(e))
+			progressLock.Unlock()
+			return
+		}
+		l.Infof("%s", downloadStatus(e))
+	case EventExtractDone:
+		if e.Files > 0 {
+			l.Debugf("expanded %d files, %s (%s)", e.Files, formatBytes(e.Bytes), e.Plugin)
+		}
+	case EventInstalled:
+		if e.Detail != "" {
+			l.Successf("linked %s -> %s", e.Plugin, e.Detail)
+			return
+		}
+		l.Successf("installed %s", e.Plugin)
+	case EventRemoved:
+		l.Infof("removed: %s", e.Plugin)
+	case EventSkipped:
+		switch e.Detail {
+		case skipDetailPinned:
+			l.Debugf("pinned %s", e.Repo)
+		case skipDetailOffline:
+			l.Warnf("offline: ネットワークが必要なのでスキップします: %s", e.Repo)
+		case skipDetailUnchanged:
+			l.Infof("unchanged %s", e.Plugin)
+		}
+	case EventError:
+		// エラーはsync/updateの最後にまとめて表示する
+		l.Debugf("error %s: %v", e.Plugin, e.Err)
+	}
+}
+
+func downloadStatus(e Event) string {
+	if e.TotalBytes <= 0 {
+		return fmt.Sprintf("%s: %s", e.Plugin, formatBytes(e.Bytes))
+	}
+	percent := e.Bytes * 100 / e.TotalBytes
+	return fmt.Sprintf("%s: %d%% (%s/%s)", e.Plugin, percent, formatBytes(e.Bytes), formatBytes(e.TotalBytes))
+}
+
+// 全体の進捗を[N/M]で表示するためのカウンタ
+// 並行でインストールしても番号が重複しないようatomicで数える
+type progressCounter struct {
+	total   int
+	started atomic.Int64
+}
+
+func (c *progressCounter) next() int {
+	return int(c.started.Add(1))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ダウンロード全体の帯域の上限（nilなら無制限）
+// 並列ダウンロードでも合計がこの値を超えないよう、全てのダウンロードで共有する
+var downloadLimiter *rateLimiter
+
+// 1秒あたりrateバイトまで読み込めるようにする
+// 読み込んだバイト数に応じて次に読み込める時刻を進め、追い越した分だけ待つ
+type rateLimiter struct {
+	rate int64
+	// 次に読み込める時刻（UnixNano）
+	next atomic.Int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// nバイト読み込んだ分だけ待つ
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	cost := time.Duration(int64(n) * int64(time.Second) / l.rate)
+	now := time.Now().UnixNano()
+	var next int64
+	for {
+		prev := l.next.Load()
+		next = max(prev, now) + int64(cost)
+		if l.next.CompareAndSwap(prev, next) {
+			break
+		}
+	}
+
+	delay := time.Duration(next - now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// 1回のReadで読み込む量を制限して、待ち時間が一度に長くならないようにする
+func (l *rateLimiter) chunkSize() int {
+	return int(max(1, min(l.rate/10, 32*1024)))
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+// 制限が無い場合はrをそのまま返す
+func limitRate(ctx context.Context, r io.Reader) io.Reader {
+	if downloadLimiter == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: downloadLimiter}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if size := r.limiter.chunkSize(); len(p) > size {
+		p = p[:size]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// 2MB、500K、1048576のような指定をバイト数にする
+// 単位は1024倍で、末尾のBやiBは省略できる
+func parseByteSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "B")
+	v = strings.TrimSuffix(v, "I")
+	var unit int64 = 1
+	if i := strings.IndexAny(v, "KMG"); i >= 0 && i == len(v)-1 {
+		unit = 1 << (10 * (strings.IndexByte("KMG", v[i]) + 1))
+		v = v[:i]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("サイズは2MBや500Kのように正の値で指定してください: %s", s)
+	}
+	return int64(n * float64(unit)), nil
+}
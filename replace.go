@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 既存のディレクトリに同じアーカイブが展開済みかどうか
+// branch追従のプラグインをupdateしても内容が変わっていなければ、展開し直さずに済ませる
+func unchangedInstall(expandedPath, u, sum string, p Plugin) bool {
+	if sum == "" || len(p.Patches) > 0 {
+		return false
+	}
+	if info, err := os.Lstat(expandedPath); err != nil || !info.IsDir() {
+		return false
+	}
+	meta, ok := readPluginMeta(expandedPath)
+	// repoやtagを書き換えただけでurlが同じ場合も、メタ情報を更新するため展開し直す
+	return ok && !meta.differs(p) && meta.Sha256 == sum && meta.Url == u && meta.Rtp == p.Rtp
+}
+
+// replacePluginDirで反映したファイルの数
+type replaceStats struct {
+	updated   int
+	removed   int
+	unchanged int
+}
+
+// 展開したsrcでdestを置き換える
+// destが既にあれば、内容が変わっていないファイルのタイムスタンプをsrcに引き継いでから入れ替える
+// destへの反映はリネームだけで行うので、途中で失敗しても古いファイルと新しいファイルが混ざらない
+func replacePluginDir(src, dest string) (replaceStats, error) {
+	info, err := os.Lstat(dest)
+	if err != nil || !info.IsDir() {
+		if err := os.RemoveAll(dest); err != nil {
+			return replaceStats{}, err
+		}
+		return replaceStats{}, os.Rename(src, dest)
+	}
+	stats, err := keepUnchangedTimes(src, dest)
+	if err != nil {
+		return stats, err
+	}
+	return stats, swapDir(src, dest)
+}
+
+// destを退避してからsrcをdestへ移動し、成功したら退避したものを削除する
+// srcの移動に失敗した場合は退避したものを元に戻す
+func swapDir(src, dest string) error {
+	backup, err := os.MkdirTemp(filepath.Dir(dest), "."+filepath.Base(dest)+"-old-*")
+	if err != nil {
+		return err
+	}
+	// 空でないディレクトリへはリネームできないので、名前だけ確保して作ったディレクトリは消す
+	if err := os.Remove(backup); err != nil {
+		return err
+	}
+	if err := os.Rename(dest, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dest); err != nil {
+		if restoreErr := os.Rename(backup, dest); restoreErr != nil {
+			return errors.Join(err, restoreErr)
+		}
+		return err
+	}
+	return os.RemoveAll(backup)
+}
+
+// srcとdestを比べ、内容が同じファイルはdestの更新日時をsrcに設定する
+// srcだけを書き換え、destには触れない
+func keepUnchangedTimes(src, dest string) (replaceStats, error) {
+	var stats replaceStats
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." || d.IsDir() {
+			return err
+		}
+		existing, err := os.Lstat(filepath.Join(dest, rel))
+		if err != nil {
+			stats.updated++
+			return nil
+		}
+		same, err := sameEntry(path, filepath.Join(dest, rel), d, existing)
+		if err != nil {
+			return err
+		}
+		if !same {
+			stats.updated++
+			return nil
+		}
+		stats.unchanged++
+		// Chtimesはリンク先を変更してしまうので、シンボリックリンクはそのままにする
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chtimes(path, time.Time{}, existing.ModTime())
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	// srcに無くなったファイルを数える
+	err = filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dest, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(src, rel)); err == nil {
+			return nil
+		}
+		stats.removed++
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// ファイルの種類・モード・内容が同じかどうか
+// サイズが同じ場合だけハッシュを計算する
+func sameEntry(src, dest string, d fs.DirEntry, existing fs.FileInfo) (bool, error) {
+	if d.Type() != existing.Mode().Type() {
+		return false, nil
+	}
+	if d.Type()&fs.ModeSymlink != 0 {
+		a, err := os.Readlink(src)
+		if err != nil {
+			return false, err
+		}
+		b, err := os.Readlink(dest)
+		return err == nil && a == b, nil
+	}
+	info, err := d.Info()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != existing.Size() || info.Mode().Perm() != existing.Mode().Perm() {
+		return false, nil
+	}
+	a, err := fileSha256(src)
+	if err != nil {
+		return false, err
+	}
+	b, err := fileSha256(dest)
+	if err != nil {
+		return false, nil
+	}
+	return bytes.Equal(a, b), nil
+}
+
+func fileSha256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
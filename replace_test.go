@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplacePluginDir(t *testing.T) {
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "foo-main")
+	src := filepath.Join(parent, ".foo-main-tmp")
+	writeTestFiles(t, dest, map[string]string{
+		"plugin/same.lua":    "same",
+		"plugin/changed.lua": "old",
+		"plugin/removed.lua": "removed",
+	})
+	writeTestFiles(t, src, map[string]string{
+		"plugin/same.lua":    "same",
+		"plugin/changed.lua": "new",
+		"plugin/added.lua":   "added",
+	})
+	old := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dest, "plugin/same.lua"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := replacePluginDir(src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (replaceStats{updated: 2, removed: 1, unchanged: 1}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	info, err := os.Stat(filepath.Join(dest, "plugin/same.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Errorf("変わっていないファイルの更新日時が変わりました: %v", info.ModTime())
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "plugin/changed.lua")); err != nil || string(data) != "new" {
+		t.Errorf("変わったファイルが更新されていません: %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "plugin/removed.lua")); err == nil {
+		t.Error("srcに無いファイルが残っています")
+	}
+
+	// 退避したディレクトリと一時ディレクトリが残っていないこと
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("不要なディレクトリが残っています: %v", entries)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// add時に受け付ける username/repo 形式
+var repoPattern = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+
+// テストではhttptestのサーバーに差し替える
+var githubApiUrl = "https://api.github.com/"
+
+// GitHub APIのレート制限に達したことを表すエラー
+var errRateLimited = errors.New("GitHub APIのレート制限に達しました（GITHUB_TOKENを設定すると制限が緩和されます）")
+
+// username/repo形式で指定されたプラグインのtagを解決する
+// 最新のreleaseタグが取れなければデフォルトブランチにフォールバックする
+func resolvePlugin(ctx context.Context, repo string) (Plugin, error) {
+	p := Plugin{Repo: repo}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	err := getGitHubApi(ctx, "repos/"+repo+"/releases/latest", &release)
+	if err == nil && release.TagName != "" {
+		p.Tag = release.TagName
+		return p, nil
+	}
+	if errors.Is(err, errRateLimited) {
+		logger.Warnf("%v", err)
+	} else if err != nil {
+		logger.Debugf("latest release not found: %v", err)
+	}
+
+	branch, err := defaultBranch(ctx, repo)
+	if err != nil {
+		return Plugin{}, err
+	}
+	p.Branch = branch
+	return p, nil
+}
+
+// APIで取得できればその値を使い、取得できなければmain→masterの順にアーカイブの存在を確認する
+// どちらも確認できなければmainとみなす
+func defaultBranch(ctx context.Context, repo string) (string, error) {
+	var info struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	err := getGitHubApi(ctx, "repos/"+repo, &info)
+	if err == nil && info.DefaultBranch != "" {
+		return info.DefaultBranch, nil
+	}
+	if errors.Is(err, errRateLimited) {
+		logger.Warnf("%v", err)
+	}
+
+	for _, branch := range []string{"main", "master"} {
+		u, err := makeUrl(Plugin{Repo: repo, Branch: branch})
+		if err != nil {
+			return "", err
+		}
+		if archiveExists(ctx, u) {
+			return branch, nil
+		}
+	}
+	logger.Warnf("%s: デフォルトブランチを確認できなかったのでmainとみなします", repo)
+	return "main", nil
+}
+
+func getGitHubApi(ctx context.Context, endpoint string, v any) error {
+	// endpointにクエリが含まれていてもエスケープされないよう、パスとクエリを分けて組み立てる
+	path, query, _ := strings.Cut(endpoint, "?")
+	u, err := url.JoinPath(githubApiUrl, path)
+	if err != nil {
+		return err
+	}
+	if query != "" {
+		u += "?" + query
+	}
+
+	// 一覧を返すAPIは、Linkヘッダのrel="next"を辿って全ページ分を連結する
+	var items []json.RawMessage
+	for page := 0; u != ""; page++ {
+		resp, err := requestGitHubApi(ctx, u)
+		if err != nil {
+			return err
+		}
+		next := nextPageUrl(resp.Header.Get("Link"))
+		if page == 0 && next == "" {
+			err := json.NewDecoder(resp.Body).Decode(v)
+			resp.Body.Close()
+			return err
+		}
+		var list []json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		items = append(items, list...)
+		u = next
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// GitHub APIにGETリクエストを送り、200以外のステータスはエラーにする
+func requestGitHubApi(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", userAgent())
+	setGitHubToken(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) &&
+		resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		resp.Body.Close()
+		return nil, errRateLimited
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &httpStatusError{url: u, statusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// Linkヘッダ（<url>; rel="next", <url>; rel="last"）から次のページのURLを取り出す
+func nextPageUrl(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		target, params, found := strings.Cut(part, ";")
+		if !found {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(target), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+func archiveExists(ctx context.Context, u string) bool {
+	return verifyUrl(ctx, u) == nil
+}
+
+// urlが取得できるかをHEADリクエストで確認する
+// HEADに対応していないサーバーには、先頭1バイトだけのGETで確認する
+func verifyUrl(ctx context.Context, u string) error {
+	resp, err := probeUrl(ctx, http.MethodHead, u)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		logger.Debugf("HEAD not allowed, fallback to GET: %s", u)
+		resp, err = probeUrl(ctx, http.MethodGet, u)
+		if err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return &httpStatusError{url: u, statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func probeUrl(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	setGitHubToken(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
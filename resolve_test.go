@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNextPageUrl(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"", ""},
+		{`<https://api.github.com/repositories/1/tags?page=2>; rel="next", <https://api.github.com/repositories/1/tags?page=5>; rel="last"`, "https://api.github.com/repositories/1/tags?page=2"},
+		{`<https://api.github.com/repositories/1/tags?page=1>; rel="prev", <https://api.github.com/repositories/1/tags?page=1>; rel="first"`, ""},
+	}
+	for _, tt := range tests {
+		if got := nextPageUrl(tt.link); got != tt.want {
+			t.Errorf("nextPageUrl(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestFetchTagsFollowsPagination(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/u/r/tags" || r.URL.Query().Get("per_page") != "100" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repos/u/r/tags?per_page=100&page=2>; rel="next"`, srv.URL))
+			fmt.Fprint(w, `[{"name":"v1.1.0"},{"name":"v1.0.0"}]`)
+		case "2":
+			fmt.Fprint(w, `[{"name":"v0.9.0"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	old := githubApiUrl
+	githubApiUrl = srv.URL + "/"
+	defer func() { githubApiUrl = old }()
+
+	tags, err := fetchTags(context.Background(), "u/r", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"v1.1.0", "v1.0.0", "v0.9.0"}; !slices.Equal(tags, want) {
+		t.Errorf("fetchTags() = %v, want %v", tags, want)
+	}
+}
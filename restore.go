@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// restoreコマンド
+// 世代付きバックアップ（デフォルトは直前の.1）からplugins.ymlを戻す
+// 戻す前の内容も.1として残るので、restoreをやり直すこともできる
+func restore(pluginsFilePath string, args []string) error {
+	generation := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("世代は1以上の数値で指定してください: %s", args[0])
+		}
+		generation = n
+	}
+
+	src := backupPath(pluginsFilePath, generation)
+	data, err := os.ReadFile(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("バックアップがありません: %s", src)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := writePluginsFile(pluginsFilePath, data); err != nil {
+		return err
+	}
+	logger.Infof("restored: %s -> %s", src, pluginsFilePath)
+	return nil
+}
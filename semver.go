@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// v1.2.3 形式のバージョン
+// プレリリース（-rc1など）は安定版の追従には使わないので比較対象にしない
+type semver struct {
+	major, minor, patch int
+}
+
+func parseSemver(s string) (semver, bool) {
+	s = strings.TrimPrefix(s, "v")
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return semver{}, false
+	}
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		nums[i] = n
+	}
+	return semver{nums[0], nums[1], nums[2]}, true
+}
+
+func (v semver) compare(o semver) int {
+	return cmp.Or(cmp.Compare(v.major, o.major), cmp.Compare(v.minor, o.minor), cmp.Compare(v.patch, o.patch))
+}
+
+// tagがsemverの制約（^1.0.0、~1.2、>=1.0 <2.0など）かどうか
+func isTagConstraint(tag string) bool {
+	return tag != "" && strings.ContainsAny(tag[:1], "^~<>=")
+}
+
+// 空白区切りの条件を全て満たすかどうか
+func satisfiesConstraint(constraint string, v semver) (bool, error) {
+	for _, cond := range strings.Fields(constraint) {
+		ok, err := satisfiesCondition(cond, v)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func satisfiesCondition(cond string, v semver) (bool, error) {
+	rest := strings.TrimLeft(cond, "^~<>=")
+	op := cond[:len(cond)-len(rest)]
+	base, ok := parseSemver(rest)
+	if !ok {
+		return false, fmt.Errorf("不正なバージョン制約です: %s", cond)
+	}
+
+	c := v.compare(base)
+	switch op {
+	case "^":
+		// メジャーバージョンが同じ範囲（0.xの場合はマイナーバージョンまで）
+		if base.major == 0 {
+			return c >= 0 && v.major == 0 && v.minor == base.minor, nil
+		}
+		return c >= 0 && v.major == base.major, nil
+	case "~":
+		return c >= 0 && v.major == base.major && v.minor == base.minor, nil
+	case ">=":
+		return c >= 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case "<":
+		return c < 0, nil
+	case "=", "":
+		return c == 0, nil
+	default:
+		return false, fmt.Errorf("不正なバージョン制約です: %s", cond)
+	}
+}
+
+// タグ一覧から制約を満たす最新のタグを選ぶ
+func selectTag(constraint string, tags []string) (string, error) {
+	var best string
+	var bestVersion semver
+	for _, tag := range tags {
+		v, ok := parseSemver(tag)
+		if !ok {
+			continue
+		}
+		matched, err := satisfiesConstraint(constraint, v)
+		if err != nil {
+			return "", err
+		}
+		if matched && (best == "" || v.compare(bestVersion) > 0) {
+			best, bestVersion = tag, v
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%sを満たすタグがありません（候補: %s）", constraint, strings.Join(tags, ", "))
+	}
+	return best, nil
+}
+
+// GitHub APIでタグ一覧を取得する
+// 100件を超える場合も、全ページを辿って全てのタグを返す
+// useCacheがtrueの場合は一定時間APIのレスポンスをキャッシュする
+func fetchTags(ctx context.Context, repo string, useCache bool) ([]string, error) {
+	var tags []struct {
+		Name string `json:"name"`
+	}
+	get := getGitHubApi
+	if useCache {
+		get = getGitHubApiCached
+	}
+	if err := get(ctx, "repos/"+repo+"/tags?per_page=100", &tags); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.Name
+	}
+	return names, nil
+}
+
+// tagにsemverの制約が書かれたプラグインについて、制約を満たす最新のタグに置き換える
+// useNetworkがfalseの場合や取得に失敗した場合は、ロックファイルに記録されたタグが制約を満たせばそれを使う
+// useNetworkがfalseで解決できなかったものは制約のまま残す
+func resolveTagConstraints(ctx context.Context, plugins *Plugins, lock *lockFile, useNetwork bool) error {
+	for _, list := range [][]Plugin{plugins.Start, plugins.Opt} {
+		for i := range list {
+			p := &list[i]
+			if !isTagConstraint(p.Tag) {
+				continue
+			}
+			constraint := p.Tag
+
+			var tag string
+			var err error
+			if useNetwork {
+				var tags []string
+				tags, err = fetchTags(ctx, p.Repo, false)
+				if err == nil {
+					tag, err = selectTag(constraint, tags)
+					if err != nil {
+						return fmt.Errorf("%s: %w", p.Repo, err)
+					}
+				}
+			}
+			if tag == "" {
+				tag = lock.lockedTag(p.Repo, constraint)
+			}
+			if tag == "" {
+				if useNetwork {
+					return fmt.Errorf("%s: %sのタグを解決できません: %w", p.Repo, constraint, err)
+				}
+				continue
+			}
+
+			logger.Debugf("resolved %s %s -> %s", p.Repo, constraint, tag)
+			p.Tag = tag
+			p.tagConstraint = constraint
+		}
+	}
+	return nil
+}
+
+// status/listなどネットワークを使わないコマンド向けに、ロックファイルに記録されたタグで制約を解決する
+func resolveLockedTags(pluginsFilePath string, plugins *Plugins) error {
+	lock, err := readLockFile(lockFilePath(pluginsFilePath))
+	if err != nil {
+		return err
+	}
+	return resolveTagConstraints(context.Background(), plugins, lock, false)
+}
+
+// ロックファイルに記録されたタグのうち、制約を満たすものを返す
+func (l *lockFile) lockedTag(repo, constraint string) string {
+	if l == nil {
+		return ""
+	}
+	for _, locked := range l.Plugins {
+		if locked.Repo != repo || locked.Constraint != constraint {
+			continue
+		}
+		v, ok := parseSemver(locked.Tag)
+		if !ok {
+			continue
+		}
+		if matched, err := satisfiesConstraint(constraint, v); err == nil && matched {
+			return locked.Tag
+		}
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+)
+
+// packディレクトリに対する変更予定
+type pendingChanges struct {
+	install []string
+	remove  []string
+	update  []string
+	// pinされていて変更しないもの（差分には含めない）
+	pinned []string
+}
+
+func (c pendingChanges) empty() bool {
+	return len(c.install) == 0 && len(c.remove) == 0 && len(c.update) == 0
+}
+
+// plugins.ymlと実際のpackディレクトリの差分を表示する
+// ファイル操作は一切行わず、差分があれば終了コード1を返す
+func status(pluginsFilePath, packPath string) error {
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	if err := resolveLockedTags(pluginsFilePath, plugins); err != nil {
+		return err
+	}
+
+	hasDiff := false
+	for _, group := range pluginGroups(packPath, plugins) {
+		changes, err := diffGroup(group)
+		if err != nil {
+			return err
+		}
+		if changes.empty() && len(changes.pinned) == 0 {
+			continue
+		}
+		hasDiff = hasDiff || !changes.empty()
+
+		logger.Infof("[%s]", group.kind)
+		for _, name := range changes.pinned {
+			logger.Infof("  pin: %s", name)
+		}
+		for _, name := range changes.install {
+			logger.Colorf(colorGreen, "  追加予定: %s", name)
+		}
+		for _, name := range changes.update {
+			logger.Colorf(colorYellow, "  更新予定: %s", name)
+		}
+		for _, name := range changes.remove {
+			logger.Colorf(colorRed, "  削除予定: %s", name)
+		}
+	}
+
+	if !hasDiff {
+		logger.Infof("up to date")
+		return nil
+	}
+	return exitCodeError(1)
+}
+
+// start/optのディレクトリ1つ分について変更予定を求める
+// 同じrepoでディレクトリ名だけが変わったものはtag変更による更新とみなす
+func diffGroup(group pluginGroup) (pendingChanges, error) {
+	var changes pendingChanges
+
+	installed, err := listDirNames(group.dir)
+	if err != nil {
+		return changes, err
+	}
+
+	defined := make(map[string]bool)
+	for _, p := range group.plugins {
+		defined[makeDirName(p)] = true
+	}
+
+	replaced := make(map[string]bool)
+	for _, p := range group.plugins {
+		dirName := makeDirName(p)
+		if p.pinned() {
+			if name, ok := findOwnedDir(p, group.dir, installed); ok {
+				replaced[name] = true
+				changes.pinned = append(changes.pinned, name)
+				continue
+			}
+		}
+		if installed[dirName] {
+			// ディレクトリ名が同じでも、メタ情報のバージョンが異なれば更新とみなす
+			if meta, ok := readPluginMeta(filepath.Join(group.dir, dirName)); ok && meta.differs(p) {
+				changes.update = append(changes.update, fmt.Sprintf("%s (%s -> %s)", dirName, meta.version(), pluginVersion(p)))
+			}
+			continue
+		}
+
+		// 同じrepoの旧バージョンのディレクトリを探す
+		old := ""
+		for _, name := range slices.Sorted(maps.Keys(installed)) {
+			if !defined[name] && !replaced[name] && ownsDir(p, filepath.Join(group.dir, name)) {
+				old = name
+				break
+			}
+		}
+		if old != "" {
+			replaced[old] = true
+			changes.update = append(changes.update, old+" -> "+dirName)
+		} else {
+			changes.install = append(changes.install, dirName)
+		}
+	}
+
+	for name := range installed {
+		if !defined[name] && !replaced[name] {
+			changes.remove = append(changes.remove, name)
+		}
+	}
+
+	slices.Sort(changes.install)
+	slices.Sort(changes.update)
+	slices.Sort(changes.remove)
+	slices.Sort(changes.pinned)
+	return changes, nil
+}
+
+// plugins.ymlで指定されたバージョン
+func pluginVersion(p Plugin) string {
+	return cmp.Or(p.Tag, p.Branch, shortCommit(p.Commit))
+}
+
+// プラグインのものとみなせるインストール済みディレクトリを探す
+func findOwnedDir(p Plugin, dir string, installed map[string]bool) (string, bool) {
+	if installed[makeDirName(p)] {
+		return makeDirName(p), true
+	}
+	for _, name := range slices.Sorted(maps.Keys(installed)) {
+		if ownsDir(p, filepath.Join(dir, name)) {
+			return name, true
+		}
+	}
+	return "", false
+}
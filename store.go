@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// trueの場合、展開済みのプラグインをストアで共有し、各packにはハードリンクで設置する（--hardlink）
+// 複数のpackで同じプラグインの同じバージョンを使う場合にディスクを節約できる
+var useHardlink = false
+
+// アーカイブを展開したものをストアに置き、その内容をdestにハードリンクで設置する
+func extractViaStore(ctx context.Context, u, zipPath, sum, dest string) error {
+	storeDir, err := extractToStore(ctx, u, zipPath, sum)
+	if err != nil {
+		return err
+	}
+	return linkTree(ctx, storeDir, dest)
+}
+
+// アーカイブのsha256ごとに展開済みのディレクトリをストアに置き、そのパスを返す
+// 同じ内容のアーカイブは一度だけ展開する
+func extractToStore(ctx context.Context, u, zipPath, sum string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	storeDir := filepath.Join(dir, "store", sum)
+	if _, err := os.Stat(storeDir); err == nil {
+		ctxLogger(ctx).Debugf("store hit %s", shortCommit(sum))
+		return storeDir, nil
+	}
+
+	// 展開途中のものを共有しないよう、一時ディレクトリに展開してからリネームする
+	if err := os.MkdirAll(filepath.Dir(storeDir), 0755); err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(storeDir), "."+sum+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, extractDirMode); err != nil {
+		return "", err
+	}
+	stats, err := extractArchiveLimited(ctx, u, zipPath, tmpDir)
+	if err != nil {
+		return "", err
+	}
+	ctxLogger(ctx).Debugf("expanded %d files, %s (store %s)", stats.files, formatBytes(stats.bytes), shortCommit(sum))
+
+	if err := os.Rename(tmpDir, storeDir); err != nil {
+		// 並行して同じアーカイブを展開した場合は、先に置かれた方を使う
+		if _, serr := os.Stat(storeDir); serr == nil {
+			return storeDir, nil
+		}
+		return "", err
+	}
+	return storeDir, nil
+}
+
+// srcのディレクトリ構成をdestに再現し、ファイルはハードリンクで設置する
+// ファイルシステムをまたぐ場合など、ハードリンクできなければコピーする
+func linkTree(ctx context.Context, src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dest, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, extractDirMode)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			return nil
+		// メタ情報はpackごとに書き込むので、ストアのファイルを共有しない
+		case d.Name() == pluginMetaFile:
+			return nil
+		}
+
+		if err := os.Link(path, target); err != nil {
+			ctxLogger(ctx).Debugf("  hardlink failed, copy %s: %v", rel, err)
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return copyFile(path, target, extractFileMode(info.Mode()))
+		}
+		return nil
+	})
+}
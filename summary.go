@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// sync中にエラーになったプラグイン
+type pluginFailure struct {
+	name string
+	err  error
+}
+
+// sync --jsonで出力するプラグインごとの処理結果
+type syncResult struct {
+	Name string `json:"name"`
+	// install/remove/skip/build/postinstall
+	Action string `json:"action"`
+	// ok/error
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// sync全体の処理結果
+type syncSummary struct {
+	installed int
+	removed   int
+	skipped   int
+	failures  []pluginFailure
+	results   []syncResult
+}
+
+func (s *syncSummary) fail(name string, err error) {
+	s.failures = append(s.failures, pluginFailure{name: name, err: err})
+}
+
+// プラグインごとの処理結果を記録する
+// 並行処理中には呼ばず、結果が揃ってからまとめて記録する
+func (s *syncSummary) record(name, action string, d time.Duration, err error) {
+	result := syncResult{Name: name, Action: action, Status: "ok", DurationMs: d.Milliseconds()}
+	if err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+	}
+	s.results = append(s.results, result)
+}
+
+// 処理結果のサマリを出力する
+// エラーがあった場合はプラグイン名と理由を束ねたエラーを返す
+func (s *syncSummary) report() error {
+	logger.Infof("インストール: %d件、削除: %d件、スキップ: %d件、エラー: %d件",
+		s.installed, s.removed, s.skipped, len(s.failures))
+	if len(s.failures) == 0 {
+		return nil
+	}
+
+	errs := []error{fmt.Errorf("%d件のプラグインでエラーが発生しました。", len(s.failures))}
+	for _, f := range s.failures {
+		errs = append(errs, fmt.Errorf("  %s: %w", f.name, f.err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 同時に複数のsyncが走らないよう、packディレクトリに置く排他ロックのファイル名
+const syncLockFileName = "ttvpack.lock"
+
+// packディレクトリのロックを取得し、解放する関数を返す
+// 既にロックされていればエラーにする
+// OSのアドバイザリロック（UNIXはflock、WindowsはLockFileEx）を使うので、
+// 異常終了したプロセスのロックはOSが解放し、残ったファイルを回収する必要はない
+// ロックファイルを削除すると、削除前に開いていたプロセスと新しく作ったプロセスが同時にロックできてしまうので、ファイルは残す
+func acquireSyncLock(packPath string) (func(), error) {
+	if err := os.MkdirAll(packPath, extractDirMode); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(packPath, syncLockFileName)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("ロックを取得できませんでした: %s: %w", path, err)
+	}
+	if !locked {
+		defer f.Close()
+		if pid := readLockPid(f); pid > 0 {
+			return nil, fmt.Errorf("別のsyncが実行中です（PID %d、ロックファイル: %s）", pid, path)
+		}
+		return nil, fmt.Errorf("別のsyncが実行中です（ロックファイル: %s）", path)
+	}
+
+	// どのプロセスが実行中か分かるよう、PIDと開始時刻を書いておく
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d\n%d\n", os.Getpid(), time.Now().Unix())), 0)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// ロックファイルに書かれたPIDを返す
+// 読めない場合は0を返す
+func readLockPid(f *os.File) int {
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, 64))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	pid, _ := strconv.Atoi(fields[0])
+	return pid
+}
@@ -0,0 +1,73 @@
+//go:build unix || windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 異常終了したプロセスが残したロックファイルを作る
+func writeStaleLock(t *testing.T, packPath string) {
+	t.Helper()
+	content := fmt.Sprintf("%d\n%d\n", 999999, 0)
+	if err := os.WriteFile(filepath.Join(packPath, syncLockFileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireSyncLock(t *testing.T) {
+	packPath := t.TempDir()
+	writeStaleLock(t, packPath)
+
+	unlock, err := acquireSyncLock(packPath)
+	if err != nil {
+		t.Fatalf("残っていたロックファイルを回収できませんでした: %v", err)
+	}
+	_, err = acquireSyncLock(packPath)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("PID %d", os.Getpid())) {
+		t.Fatalf("err = %v, want 実行中のPIDを含むエラー", err)
+	}
+
+	unlock()
+	unlock, err = acquireSyncLock(packPath)
+	if err != nil {
+		t.Fatalf("解放したロックを取得できませんでした: %v", err)
+	}
+	unlock()
+}
+
+func TestAcquireSyncLockContention(t *testing.T) {
+	packPath := t.TempDir()
+	writeStaleLock(t, packPath)
+
+	// 残っていたロックを同時に回収しようとしても、取得できるのは1つだけ
+	const n = 8
+	start := make(chan struct{})
+	results := make(chan func(), n)
+	for range n {
+		go func() {
+			<-start
+			unlock, err := acquireSyncLock(packPath)
+			if err != nil {
+				unlock = nil
+			}
+			results <- unlock
+		}()
+	}
+	close(start)
+
+	acquired := 0
+	for range n {
+		if unlock := <-results; unlock != nil {
+			acquired++
+			defer unlock()
+		}
+	}
+	if acquired != 1 {
+		t.Errorf("%d個のプロセスがロックを取得しました", acquired)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// ロックする範囲
+// LockFileExのロックは読み込みも妨げるので、PIDを書く先頭ではなくファイルの末尾より先の1バイトをロックする
+var lockRange = windows.Overlapped{Offset: 0xffffffff, OffsetHigh: 0x7fffffff}
+
+// ファイルに排他ロックをかける
+// 他のプロセスがロックしていれば待たずにfalseを返す
+func tryLockFile(f *os.File) (bool, error) {
+	ol := lockRange
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	ol := lockRange
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
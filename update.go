@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"slices"
+)
+
+// branch追従のプラグインを強制的に再ダウンロードする
+// nameを指定した場合はrepoのベース名が一致するものだけを対象にする
+func update(ctx context.Context, pluginsFilePath, packPath string, args []string) error {
+	flags := flag.NewFlagSet("update", flag.ContinueOnError)
+	jobs := flags.Int("jobs", downloadJobs, "同時にダウンロードするプラグインの数（1で逐次実行）")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := setDownloadJobs(*jobs); err != nil {
+		return err
+	}
+
+	unlock, err := acquireSyncLock(packPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+	lockPath := lockFilePath(pluginsFilePath)
+	lock, err := readLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	// semverの制約のプラグインは更新対象ではないので、ロックファイルに記録されたタグのまま書き戻す
+	if err := resolveTagConstraints(ctx, plugins, lock, false); err != nil {
+		return err
+	}
+
+	var name string
+	if flags.NArg() > 0 {
+		name = flags.Arg(0)
+	}
+
+	type target struct {
+		kind   string
+		dir    string
+		plugin Plugin
+	}
+	var targets []target
+	for _, group := range pluginGroups(packPath, plugins) {
+		for _, p := range group.plugins {
+			// tag/commit固定のもの、pinされたもの（パッチを当てたものを含む）は更新しない
+			if p.Tag != "" || p.Commit != "" || p.Branch == "" || p.pinned() {
+				continue
+			}
+			if name != "" && p.name() != name {
+				continue
+			}
+			targets = append(targets, target{kind: group.kind, dir: group.dir, plugin: p})
+		}
+	}
+
+	if len(targets) == 0 {
+		if name != "" {
+			return fmt.Errorf("更新対象のプラグインが見つかりません: %s", name)
+		}
+		logger.Infof("no plugins to update")
+		return nil
+	}
+
+	logger.Infof("update targets:")
+	for _, t := range targets {
+		logger.Infof("  %s (%s)", t.plugin.Repo, t.plugin.Branch)
+	}
+
+	// 致命的なエラーの場合だけ全体をキャンセルし、それ以外のエラーは最後にまとめて報告する
+	counter := &progressCounter{total: len(targets)}
+	results := make([]lockedPlugin, len(targets))
+	errs := make([]error, len(targets))
+	runner := newPluginRunner()
+	gctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	for i, t := range targets {
+		runner.run(gctx, func(ctx context.Context) {
+			events.emit(ctx, Event{Plugin: makeDirName(t.plugin), Kind: EventUpdateStart, Repo: t.plugin.Repo, Index: counter.next(), Total: counter.total})
+			locked, err := installPlugin(ctx, t.dir, t.plugin)
+			if err != nil {
+				events.emit(ctx, Event{Plugin: makeDirName(t.plugin), Kind: EventError, Repo: t.plugin.Repo, Err: err})
+				errs[i] = fmt.Errorf("%s: %w", makeDirName(t.plugin), err)
+				if isFatal(err) {
+					cancel(err)
+				}
+				return
+			}
+			locked.Kind = t.kind
+			results[i] = locked
+		})
+	}
+	runner.wait()
+	if gctx.Err() != nil && ctx.Err() == nil {
+		return fmt.Errorf("致命的なエラーのため中断しました: %w", context.Cause(gctx))
+	}
+
+	for i, t := range targets {
+		if errs[i] != nil {
+			continue
+		}
+		if err := runBuild(ctx, filepath.Join(t.dir, makeDirName(t.plugin)), t.plugin); err != nil {
+			errs[i] = err
+			continue
+		}
+		if err := runPostinstallNvim(ctx, t.kind, t.plugin); err != nil {
+			errs[i] = err
+		}
+	}
+
+	// 更新したプラグインのロック情報を差し替える
+	updated := slices.DeleteFunc(results, func(l lockedPlugin) bool { return l.Repo == "" })
+	if err := writeLockFile(lockPath, makeLockFile(plugins, lock, updated, nil)); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
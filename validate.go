@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// validateコマンド
+// CI向けにネットワークを使わずplugins.ymlを検証する
+// 構文・必須フィールド・include間の重複・ディレクトリ名の衝突・循環依存はloadPluginsで検出し、
+// ここではurlが組み立てられるかなど、インストール時に初めて分かる問題を検出する
+func validate(pluginsFilePath string) error {
+	plugins, err := loadPlugins(pluginsFilePath)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	check := func(kind string, list []Plugin) {
+		for _, p := range enabledPlugins(list) {
+			// makeUrlのエラーにはrepoが含まれている
+			if _, err := pluginUrl(p); err != nil {
+				errs = append(errs, err)
+			}
+			if isTagConstraint(p.Tag) {
+				if _, err := satisfiesConstraint(p.Tag, semver{}); err != nil {
+					errs = append(errs, fmt.Errorf("%s (%s): %w", p.Repo, kind, err))
+				}
+			}
+			for _, patch := range p.Patches {
+				if _, err := os.Stat(patch); err != nil {
+					errs = append(errs, fmt.Errorf("%s (%s): パッチが見つかりません: %s", p.Repo, kind, patch))
+				}
+			}
+			if p.Sha256 != "" {
+				if b, err := hex.DecodeString(p.Sha256); err != nil || len(b) != 32 {
+					errs = append(errs, fmt.Errorf("%s (%s): sha256は64桁の16進数で指定してください: %s", p.Repo, kind, p.Sha256))
+				}
+			}
+		}
+	}
+	check("start", plugins.Start)
+	check("opt", plugins.Opt)
+	if len(errs) > 0 {
+		return fmt.Errorf("%s:\n%w", pluginsFilePath, errors.Join(errs...))
+	}
+
+	logger.Successf("%s: OK (start: %d件、opt: %d件)", pluginsFilePath, len(plugins.Start), len(plugins.Opt))
+	return nil
+}
+
+// plugins.ymlの各エントリを検証する
+// 問題のあるエントリは行番号付きでまとめて返す
+func validatePlugins(data []byte, plugins *Plugins) error {
+	file, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	check := func(kind string, list []Plugin) {
+		for i, p := range list {
+			var msgs []string
+			if strings.TrimSpace(p.Repo) == "" {
+				msgs = append(msgs, "repoが指定されていません")
+			}
+			if p.Tag == "" && p.Branch == "" && p.Commit == "" && p.Url == "" {
+				msgs = append(msgs, "tag/branch/commit/urlのいずれかを指定してください")
+			}
+			// repoが無い場合は上のエラーだけにする
+			if p.Name != "" || strings.TrimSpace(p.Repo) != "" {
+				if err := checkPluginName(p.name()); err != nil {
+					msgs = append(msgs, err.Error())
+				}
+			}
+			if p.Check != "" && !filepath.IsLocal(filepath.FromSlash(p.Check)) {
+				msgs = append(msgs, "checkにはプラグインのディレクトリからの相対パスを指定してください: "+p.Check)
+			}
+			for _, msg := range msgs {
+				errs = append(errs, fmt.Errorf("%s%s[%d]: %s", lineOf(file, kind, i), kind, i, msg))
+			}
+		}
+	}
+	check("start", plugins.Start)
+	check("opt", plugins.Opt)
+
+	return errors.Join(errs...)
+}
+
+// インストール先のディレクトリ名になるプラグイン名（nameまたはrepoのベース名）を検証する
+// "."や".."はpackディレクトリ自身や親ディレクトリを指してしまう
+func checkPluginName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("プラグイン名にディレクトリ名として使えない値が指定されています: %q", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("プラグイン名にパスの区切り文字は使えません: %q", name)
+	}
+	return nil
+}
+
+// エントリの行番号を"line N: "の形式で返す
+// 取得できない場合は空文字を返す
+func lineOf(file *ast.File, kind string, index int) string {
+	path, err := yaml.PathString(fmt.Sprintf("$.%s[%d]", kind, index))
+	if err != nil {
+		return ""
+	}
+	node, err := path.FilterFile(file)
+	if err != nil || node == nil || node.GetToken() == nil {
+		return ""
+	}
+	return fmt.Sprintf("line %d: ", node.GetToken().Position.Line)
+}
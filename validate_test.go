@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPluginName(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`} {
+		if err := checkPluginName(name); err == nil {
+			t.Errorf("checkPluginName(%q) はエラーになるべき", name)
+		}
+	}
+	for _, name := range []string{"foo", "foo.nvim", ".foo", "..foo"} {
+		if err := checkPluginName(name); err != nil {
+			t.Errorf("checkPluginName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestValidatePluginsRejectsUnsafeName(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"nameが..", "start:\n  - repo: u/foo\n    name: ..\n    tag: v1\n"},
+		{"nameが.", "start:\n  - repo: u/foo\n    name: .\n    tag: v1\n"},
+		{"nameに区切り文字", "start:\n  - repo: u/foo\n    name: a/b\n    tag: v1\n"},
+		{"repoのベース名が..", "start:\n  - repo: u/..\n    tag: v1\n"},
+		{"repoのベース名が.", "start:\n  - repo: u/.\n    tag: v1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestPluginsFile(t, tt.yaml)
+			_, err := readPlugins(path)
+			if err == nil || !strings.Contains(err.Error(), "プラグイン名") {
+				t.Fatalf("err = %v, want プラグイン名のエラー", err)
+			}
+		})
+	}
+}
+
+func TestMakeDirNameNeverPointsOutside(t *testing.T) {
+	for _, name := range []string{".", ".."} {
+		got := makeDirName(Plugin{Repo: "u/foo", Name: name, Url: "https://example.com/foo.zip"})
+		if got == "." || got == ".." || got == "" {
+			t.Errorf("makeDirName(name: %q) = %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// ビルド時に -ldflags で埋め込む情報
+// 例: go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+// 埋め込まれていない場合はgo installなどで記録されたモジュール・VCSの情報を使う
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type buildInfo struct {
+	version   string
+	commit    string
+	date      string
+	goVersion string
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{version: version, commit: commit, date: buildDate, goVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		// go install ...@v1.2.3 でインストールした場合はモジュールのバージョンが入る
+		if info.version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.version = bi.Main.Version
+		}
+		var revision, vcsTime string
+		modified := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.time":
+				vcsTime = s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if info.commit == "" && revision != "" {
+			info.commit = revision
+			if modified {
+				info.commit += "-dirty"
+			}
+		}
+		info.date = cmp.Or(info.date, vcsTime)
+	}
+	return info
+}
+
+// HTTPリクエストに付けるUser-Agent
+// GitHubや一部のCDNはUser-Agentの無いリクエストを拒否することがある
+func userAgent() string {
+	return "ttvpack/" + currentBuildInfo().version
+}
+
+// バグ報告に必要なビルド情報を表示する
+func printVersion() {
+	info := currentBuildInfo()
+	fmt.Printf("ttvpack %s\n", info.version)
+	fmt.Printf("  commit: %s\n", cmp.Or(info.commit, "unknown"))
+	fmt.Printf("  built:  %s\n", cmp.Or(info.date, "unknown"))
+	fmt.Printf("  go:     %s %s/%s\n", info.goVersion, runtime.GOOS, runtime.GOARCH)
+}
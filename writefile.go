@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// trueの場合、plugins.ymlを書き換える前に元の内容を.bakとして残す
+var backupPluginsFile = false
+
+// plugins.ymlを書き換える前に残す世代付きバックアップ（plugins.yml.1〜plugins.yml.N）の数
+// .1が最も新しい。0の場合は残さない
+var backupGenerations = 5
+
+// plugins.ymlをアトミックに書き換える
+// 同じディレクトリの一時ファイルに書いてからRenameするので、途中で失敗しても元のファイルは壊れない
+// 既存ファイルがあればパーミッションと所有者を引き継ぐ
+func writePluginsFile(path string, data []byte) error {
+	mode := fs.FileMode(0644)
+	info, err := os.Stat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if info != nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	// Rename後は存在しないので、失敗時の後始末にだけ効く
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+	if info != nil {
+		if err := chownLike(tmpPath, info); err != nil {
+			return err
+		}
+	}
+
+	if backupPluginsFile && info != nil {
+		if err := copyFile(path, path+".bak", mode); err != nil {
+			return err
+		}
+	}
+	if info != nil {
+		if err := rotateBackups(path, mode); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// 世代付きバックアップのパス
+func backupPath(path string, generation int) string {
+	return fmt.Sprintf("%s.%d", path, generation)
+}
+
+// .1〜.N-1を1つずつずらし、現在の内容を.1として残す
+// 保持数を超えた古いものは削除する
+func rotateBackups(path string, mode fs.FileMode) error {
+	if backupGenerations <= 0 {
+		return nil
+	}
+	if err := os.Remove(backupPath(path, backupGenerations)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for i := backupGenerations - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(path, i), backupPath(path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return copyFile(path, backupPath(path, 1), mode)
+}
+
+func copyFile(src, dest string, mode fs.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest, data, mode)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// Unix以外では所有者を引き継がない
+func chownLike(path string, info fs.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// infoと同じ所有者にする
+// 他人のファイルを書き換える権限が無い場合などは変更できないので、所有者が同じなら何もしない
+func chownLike(path string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(stat.Uid) == os.Getuid() && int(stat.Gid) == os.Getgid() {
+		return nil
+	}
+	return os.Chown(path, int(stat.Uid), int(stat.Gid))
+}
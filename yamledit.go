@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// plugins.ymlをコメントや空行を保ったまま編集するためのAST
+// 構造体にUnmarshalして書き戻すとコメントが全て消えるので、add/rmではノードを直接操作する
+type pluginsDoc struct {
+	file *ast.File
+	root *ast.MappingNode
+}
+
+func readPluginsDoc(path string) (*pluginsDoc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := parser.ParseBytes(data, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("%s:\n%s", path, yaml.FormatError(err, false, true))
+	}
+	doc := &pluginsDoc{file: file}
+	if len(file.Docs) > 0 && file.Docs[0].Body != nil {
+		root, ok := file.Docs[0].Body.(*ast.MappingNode)
+		if !ok {
+			return nil, fmt.Errorf("%s: トップレベルがマッピングではありません", path)
+		}
+		doc.root = root
+	}
+	return doc, nil
+}
+
+// start/optのキーに対応するノードを返す
+func (d *pluginsDoc) entry(kind string) *ast.MappingValueNode {
+	if d.root == nil {
+		return nil
+	}
+	for _, mv := range d.root.Values {
+		if mv.Key.GetToken().Value == kind {
+			return mv
+		}
+	}
+	return nil
+}
+
+// start/optの末尾にプラグインを追加する
+// 既存のエントリとそのコメントには触れない
+func (d *pluginsDoc) appendPlugin(kind string, p Plugin) error {
+	node, err := yaml.ValueToNode(p, yaml.Indent(2), yaml.IndentSequence(true))
+	if err != nil {
+		return err
+	}
+
+	mv := d.entry(kind)
+	if seq, ok := blockSequence(mv); ok {
+		// 既存のエントリと同じ桁に揃える
+		node.AddColumn(seq.Values[0].GetToken().Position.Column - node.GetToken().Position.Column)
+		seq.Values = append(seq.Values, node)
+		if len(seq.ValueHeadComments) > 0 {
+			seq.ValueHeadComments = append(seq.ValueHeadComments, nil)
+		}
+		return nil
+	}
+
+	// キーが無い、または空の場合は、そのキーの部分だけを作り直す
+	generated, err := yaml.ValueToNode(map[string][]Plugin{kind: {p}}, yaml.Indent(2), yaml.IndentSequence(true))
+	if err != nil {
+		return err
+	}
+	newEntry := generated.(*ast.MappingNode).Values[0]
+	switch {
+	case d.root == nil:
+		d.root = generated.(*ast.MappingNode)
+		if len(d.file.Docs) == 0 {
+			d.file.Docs = append(d.file.Docs, ast.Document(nil, d.root))
+		} else {
+			d.file.Docs[0].Body = d.root
+		}
+	case mv == nil:
+		d.root.Values = append(d.root.Values, newEntry)
+	default:
+		newEntry.Value.AddColumn(mv.Key.GetToken().Position.Column - newEntry.Key.GetToken().Position.Column)
+		mv.Value = newEntry.Value
+	}
+	return nil
+}
+
+// start/optのindex番目のエントリを、その直前のコメントと一緒に削除する
+func (d *pluginsDoc) removePlugin(kind string, index int) error {
+	mv := d.entry(kind)
+	seq, ok := blockSequence(mv)
+	if !ok || index < 0 || index >= len(seq.Values) {
+		return fmt.Errorf("%sの%d番目のエントリが見つかりません", kind, index)
+	}
+
+	// 先頭のエントリのコメントはシーケンス自体のコメントとして保持されている
+	if index == 0 {
+		seq.Comment = nil
+	}
+	seq.Values = append(seq.Values[:index], seq.Values[index+1:]...)
+	if len(seq.ValueHeadComments) > index {
+		seq.ValueHeadComments = append(seq.ValueHeadComments[:index], seq.ValueHeadComments[index+1:]...)
+	}
+	// 空のブロック形式は書き出せないので"opt: []"にする
+	if len(seq.Values) == 0 {
+		empty, err := yaml.ValueToNode([]Plugin{})
+		if err != nil {
+			return err
+		}
+		mv.Value = empty
+	}
+	return nil
+}
+
+func (d *pluginsDoc) bytes() []byte {
+	s := d.file.String()
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return []byte(s)
+}
+
+// 書き戻す前に、編集後の内容がplugins.ymlとして読めることを確認する
+func (d *pluginsDoc) write(path string) error {
+	data := d.bytes()
+	var plugins Plugins
+	if err := yaml.UnmarshalWithOptions(data, &plugins, yaml.DisallowUnknownField()); err != nil {
+		return errors.Join(errors.New("編集後のplugins.ymlを読み込めませんでした"), err)
+	}
+	return writePluginsFile(path, data)
+}
+
+// 要素が1つ以上あるブロック形式のシーケンスならそれを返す
+func blockSequence(mv *ast.MappingValueNode) (*ast.SequenceNode, bool) {
+	if mv == nil {
+		return nil, false
+	}
+	seq, ok := mv.Value.(*ast.SequenceNode)
+	if !ok || seq.IsFlowStyle || len(seq.Values) == 0 {
+		return nil, false
+	}
+	return seq, true
+}